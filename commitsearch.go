@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const searchDateLayout = "2006-01-02"
+
+// CommitQuery filters commit history. Terms match the commit message or a
+// hash prefix; author: and committer: match name or email.
+type CommitQuery struct {
+	Terms     []string
+	Author    string
+	Committer string
+	Hash      string
+	After     time.Time
+	Before    time.Time
+}
+
+func ParseCommitQuery(q string) (CommitQuery, error) {
+	var query CommitQuery
+	for _, field := range strings.Fields(q) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			query.Terms = append(query.Terms, strings.ToLower(field))
+			continue
+		}
+		var err error
+		switch key {
+		case "author":
+			query.Author = strings.ToLower(value)
+		case "committer":
+			query.Committer = strings.ToLower(value)
+		case "hash":
+			query.Hash = strings.ToLower(value)
+		case "after":
+			query.After, err = time.Parse(searchDateLayout, value)
+		case "before":
+			query.Before, err = time.Parse(searchDateLayout, value)
+		default:
+			query.Terms = append(query.Terms, strings.ToLower(field))
+		}
+		if err != nil {
+			return query, fmt.Errorf("%s: dates must look like %s", field, searchDateLayout)
+		}
+	}
+	return query, nil
+}
+
+func matchSignature(sig object.Signature, s string) bool {
+	return strings.Contains(strings.ToLower(sig.Name), s) ||
+		strings.Contains(strings.ToLower(sig.Email), s)
+}
+
+func (q CommitQuery) Match(c *object.Commit) bool {
+	hash := c.Hash.String()
+	if q.Hash != "" && !strings.HasPrefix(hash, q.Hash) {
+		return false
+	}
+	if q.Author != "" && !matchSignature(c.Author, q.Author) {
+		return false
+	}
+	if q.Committer != "" && !matchSignature(c.Committer, q.Committer) {
+		return false
+	}
+	if !q.After.IsZero() && c.Committer.When.Before(q.After) {
+		return false
+	}
+	if !q.Before.IsZero() && !c.Committer.When.Before(q.Before) {
+		return false
+	}
+	message := strings.ToLower(c.Message)
+	for _, term := range q.Terms {
+		if !strings.Contains(message, term) && !strings.HasPrefix(hash, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchCommits walks the history reachable from revision and returns at most
+// limit commits matching query.
+func SearchCommits(repo *git.Repository, revision plumbing.Hash, query CommitQuery, limit int) ([]*object.Commit, error) {
+	cIter, err := repo.Log(&git.LogOptions{From: revision, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return nil, err
+	}
+	defer cIter.Close()
+	var commits []*object.Commit
+	for len(commits) < limit {
+		commit, err := cIter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return commits, err
+		}
+		if query.Match(commit) {
+			commits = append(commits, commit)
+		}
+	}
+	return commits, nil
+}
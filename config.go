@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Duration is a time.Duration written as "90s" or "1h" in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"1m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+type Link struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// SiteConfig is what the pages say about the site.
+type SiteConfig struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	BaseURL     string `json:"base_url"`
+	Author      string `json:"author"`
+	Email       string `json:"email"`
+	Links       []Link `json:"links"`
+}
+
+// CloneConfig holds the templates of the clone URLs shown on repository
+// pages. They see .BaseURL, .Host and .Repo, an empty template hides the URL.
+type CloneConfig struct {
+	HTTP string `json:"http,omitempty"`
+	SSH  string `json:"ssh,omitempty"`
+}
+
+type PageSizes struct {
+	Log     int `json:"log,omitempty"`
+	Search  int `json:"search,omitempty"`
+	Compare int `json:"compare,omitempty"`
+}
+
+// Features switches parts of Smithy off. Unset fields keep their default.
+type Features struct {
+	Create  *bool `json:"create,omitempty"`
+	Import  *bool `json:"import,omitempty"`
+	Fork    *bool `json:"fork,omitempty"`
+	Search  *bool `json:"search,omitempty"`
+	Push    *bool `json:"push,omitempty"`
+	Mirrors *bool `json:"mirrors,omitempty"`
+}
+
+func enabled(b *bool) bool {
+	return b == nil || *b
+}
+
+func (f Features) CreateEnabled() bool  { return enabled(f.Create) }
+func (f Features) ImportEnabled() bool  { return enabled(f.Import) }
+func (f Features) ForkEnabled() bool    { return enabled(f.Fork) }
+func (f Features) SearchEnabled() bool  { return enabled(f.Search) }
+func (f Features) PushEnabled() bool    { return enabled(f.Push) }
+func (f Features) MirrorsEnabled() bool { return enabled(f.Mirrors) }
+
+// UploadPack sets the uploadpack options git serves clones and fetches
+// with. Partial clones need filters and fetch the missing blobs later by
+// their id, which reachable wants allow. Unset fields keep their default:
+// filters and reachable wants are allowed, any wants are not.
+type UploadPack struct {
+	AllowFilter              *bool `json:"allow_filter,omitempty"`
+	AllowReachableSHA1InWant *bool `json:"allow_reachable_sha1_in_want,omitempty"`
+	AllowAnySHA1InWant       *bool `json:"allow_any_sha1_in_want,omitempty"`
+}
+
+func (u UploadPack) FilterAllowed() bool { return enabled(u.AllowFilter) }
+
+// ReachableSHA1InWantAllowed reports whether clients may want any object a
+// ref reaches, any wants imply it.
+func (u UploadPack) ReachableSHA1InWantAllowed() bool {
+	return enabled(u.AllowReachableSHA1InWant) || u.AnySHA1InWantAllowed()
+}
+
+// AnySHA1InWantAllowed reports whether clients may want objects no ref
+// reaches, like those of deleted branches. It is off unless set.
+func (u UploadPack) AnySHA1InWantAllowed() bool {
+	return u.AllowAnySHA1InWant != nil && *u.AllowAnySHA1InWant
+}
+
+// GitOptions are the -c options of git upload-pack.
+func (u UploadPack) GitOptions() []string {
+	return []string{
+		"-c", "uploadpack.allowFilter=" + strconv.FormatBool(u.FilterAllowed()),
+		// Turning any wants off clears reachable wants too, it goes first.
+		"-c", "uploadpack.allowAnySHA1InWant=" + strconv.FormatBool(u.AnySHA1InWantAllowed()),
+		"-c", "uploadpack.allowReachableSHA1InWant=" + strconv.FormatBool(u.ReachableSHA1InWantAllowed()),
+	}
+}
+
+// RepoConfig overrides the site wide settings for one repository.
+type RepoConfig struct {
+	Clone      CloneConfig `json:"clone"`
+	PageSize   PageSizes   `json:"page_size"`
+	Features   Features    `json:"features"`
+	UploadPack UploadPack  `json:"upload_pack"`
+}
+
+type Config struct {
+	Listen     []string              `json:"listen"`
+	Root       string                `json:"root"`
+	Index      string                `json:"index"`
+	Keyring    string                `json:"keyring"`
+	AdminToken string                `json:"admin_token"`
+	Rescan     Duration              `json:"rescan"`
+	Templates  string                `json:"templates"`
+	Static     string                `json:"static"`
+	Dev        bool                  `json:"dev"`
+	GitBackend string                `json:"git_backend"`
+	Site       SiteConfig            `json:"site"`
+	Clone      CloneConfig           `json:"clone"`
+	PageSize   PageSizes             `json:"page_size"`
+	Features   Features              `json:"features"`
+	UploadPack UploadPack            `json:"upload_pack"`
+	Repos      map[string]RepoConfig `json:"repos"`
+}
+
+func DefaultConfig() *Config {
+	home, _ := os.UserHomeDir()
+	cache, _ := os.UserCacheDir()
+	return &Config{
+		Listen: []string{":3456"},
+		Root:   path.Join(home, "Projects"),
+		Index:  path.Join(cache, "smithy", "search"),
+		Rescan: Duration(time.Minute),
+		// "git" runs the git binary for the git protocols, "go" serves smart
+		// HTTP with go-git. Release archives and SSH still need git.
+		GitBackend: GitBackendExec,
+		Site: SiteConfig{
+			Name: "Smithy",
+		},
+		Clone: CloneConfig{
+			HTTP: "{{ .BaseURL }}/{{ .Repo }}",
+		},
+		PageSize: PageSizes{
+			Log:     500,
+			Search:  maxSearchResults,
+			Compare: 500,
+		},
+	}
+}
+
+// restartOnly names the settings that differ between current and next but
+// are only read at startup: the listeners, the watcher and the search index
+// are set up once.
+func restartOnly(current, next *Config) []string {
+	var fields []string
+	if !reflect.DeepEqual(current.Listen, next.Listen) {
+		fields = append(fields, "listen")
+	}
+	if current.Root != next.Root {
+		fields = append(fields, "root")
+	}
+	if current.Index != next.Index {
+		fields = append(fields, "index")
+	}
+	if current.Keyring != next.Keyring {
+		fields = append(fields, "keyring")
+	}
+	if current.Rescan != next.Rescan {
+		fields = append(fields, "rescan")
+	}
+	return fields
+}
+
+// ReadConfig reads the JSON config file at name over the defaults.
+func ReadConfig(name string) (*Config, error) {
+	cfg := DefaultConfig()
+	if name == "" {
+		return cfg, nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := bytes.Count(b[:syntaxErr.Offset], []byte("\n")) + 1
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return cfg, nil
+}
+
+// ApplyEnv overrides the config with the SMITHY_* environment variables.
+func (cfg *Config) ApplyEnv() error {
+	vars := []struct {
+		name  string
+		apply func(string) error
+	}{
+		{"SMITHY_LISTEN", func(v string) error { cfg.Listen = strings.Split(v, ","); return nil }},
+		{"SMITHY_ROOT", func(v string) error { cfg.Root = v; return nil }},
+		{"SMITHY_INDEX", func(v string) error { cfg.Index = v; return nil }},
+		{"SMITHY_KEYRING", func(v string) error { cfg.Keyring = v; return nil }},
+		{"SMITHY_ADMIN_TOKEN", func(v string) error { cfg.AdminToken = v; return nil }},
+		{"SMITHY_SITE_NAME", func(v string) error { cfg.Site.Name = v; return nil }},
+		{"SMITHY_BASE_URL", func(v string) error { cfg.Site.BaseURL = v; return nil }},
+		{"SMITHY_TEMPLATES", func(v string) error { cfg.Templates = v; return nil }},
+		{"SMITHY_STATIC", func(v string) error { cfg.Static = v; return nil }},
+		{"SMITHY_GIT_BACKEND", func(v string) error { cfg.GitBackend = v; return nil }},
+		{"SMITHY_DEV", func(v string) (err error) { cfg.Dev, err = strconv.ParseBool(v); return err }},
+		{"SMITHY_RESCAN", func(v string) error {
+			d, err := time.ParseDuration(v)
+			cfg.Rescan = Duration(d)
+			return err
+		}},
+	}
+	for _, v := range vars {
+		if value, ok := os.LookupEnv(v.name); ok {
+			if err := v.apply(value); err != nil {
+				return fmt.Errorf("%s: %w", v.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks the config and fills in what is derived from it. All
+// problems are reported at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if len(cfg.Listen) == 0 {
+		errs = append(errs, errors.New("listen: at least one address is needed"))
+	}
+	for _, addr := range cfg.Listen {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("listen: %w", err))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			errs = append(errs, fmt.Errorf("listen: %s: invalid port", addr))
+		}
+	}
+	if fi, err := os.Stat(cfg.Root); err != nil {
+		errs = append(errs, fmt.Errorf("root: %w", err))
+	} else if !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("root: %s is not a directory", cfg.Root))
+	}
+	for _, dir := range []struct{ key, path string }{{"templates", cfg.Templates}, {"static", cfg.Static}} {
+		if dir.path != "" && !isDir(dir.path) {
+			errs = append(errs, fmt.Errorf("%s: %s is not a directory", dir.key, dir.path))
+		}
+	}
+	switch cfg.GitBackend {
+	case GitBackendExec:
+		if _, err := exec.LookPath("git"); err != nil {
+			errs = append(errs, fmt.Errorf("git_backend: %w, use the go backend without git", err))
+		}
+	case GitBackendGo:
+	default:
+		errs = append(errs, fmt.Errorf("git_backend: %q is neither git nor go", cfg.GitBackend))
+	}
+	if cfg.Index == "" {
+		errs = append(errs, errors.New("index: the search index needs a directory"))
+	}
+	if time.Duration(cfg.Rescan) < time.Second {
+		errs = append(errs, errors.New("rescan: must be at least 1s"))
+	}
+
+	if cfg.Site.BaseURL == "" && len(errs) == 0 {
+		host, port, _ := net.SplitHostPort(cfg.Listen[0])
+		if host == "" {
+			host = "localhost"
+		}
+		cfg.Site.BaseURL = "http://" + net.JoinHostPort(host, port)
+	}
+	cfg.Site.BaseURL = strings.TrimSuffix(cfg.Site.BaseURL, "/")
+	if u, err := url.Parse(cfg.Site.BaseURL); cfg.Site.BaseURL != "" && (err != nil || !u.IsAbs()) {
+		errs = append(errs, fmt.Errorf("site.base_url: %q is not an absolute URL", cfg.Site.BaseURL))
+	}
+
+	if _, err := parseCloneTemplate(cfg.Clone.HTTP); err != nil {
+		errs = append(errs, fmt.Errorf("clone.http: %w", err))
+	}
+	if _, err := parseCloneTemplate(cfg.Clone.SSH); err != nil {
+		errs = append(errs, fmt.Errorf("clone.ssh: %w", err))
+	}
+	errs = append(errs, cfg.PageSize.validate("page_size", false)...)
+	for name, repo := range cfg.Repos {
+		if err := ValidateRepoName(strings.TrimSuffix(name, ".git")); err != nil {
+			errs = append(errs, fmt.Errorf("repos.%s: %w", name, err))
+		}
+		for _, tmpl := range []string{repo.Clone.HTTP, repo.Clone.SSH} {
+			if _, err := parseCloneTemplate(tmpl); err != nil {
+				errs = append(errs, fmt.Errorf("repos.%s.clone: %w", name, err))
+			}
+		}
+		errs = append(errs, repo.PageSize.validate("repos."+name+".page_size", true)...)
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the sizes are positive. Overrides may leave them at zero
+// to inherit the site wide size.
+func (ps PageSizes) validate(prefix string, override bool) []error {
+	var errs []error
+	sizes := []struct {
+		key string
+		n   int
+	}{{"log", ps.Log}, {"search", ps.Search}, {"compare", ps.Compare}}
+	for _, size := range sizes {
+		if size.n < 0 || size.n == 0 && !override {
+			errs = append(errs, fmt.Errorf("%s.%s: must be positive", prefix, size.key))
+		}
+	}
+	return errs
+}
+
+func parseCloneTemplate(s string) (*template.Template, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := template.New("clone").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	// Catch unknown fields now rather than on every page.
+	return t, t.Execute(new(bytes.Buffer), cloneURLData{})
+}
+
+type cloneURLData struct {
+	BaseURL, Host, Repo string
+}
+
+// For returns the settings of repo, the site wide ones with the overrides
+// of the repository applied.
+func (cfg *Config) For(repo string) RepoConfig {
+	rc := RepoConfig{Clone: cfg.Clone, PageSize: cfg.PageSize, Features: cfg.Features, UploadPack: cfg.UploadPack}
+	override, ok := cfg.Repos[repo]
+	if !ok {
+		override, ok = cfg.Repos[strings.TrimSuffix(repo, ".git")]
+	}
+	if !ok {
+		return rc
+	}
+	if override.Clone.HTTP != "" {
+		rc.Clone.HTTP = override.Clone.HTTP
+	}
+	if override.Clone.SSH != "" {
+		rc.Clone.SSH = override.Clone.SSH
+	}
+	if override.PageSize.Log > 0 {
+		rc.PageSize.Log = override.PageSize.Log
+	}
+	if override.PageSize.Search > 0 {
+		rc.PageSize.Search = override.PageSize.Search
+	}
+	if override.PageSize.Compare > 0 {
+		rc.PageSize.Compare = override.PageSize.Compare
+	}
+	for _, f := range []struct{ dst, src **bool }{
+		{&rc.Features.Create, &override.Features.Create},
+		{&rc.Features.Import, &override.Features.Import},
+		{&rc.Features.Fork, &override.Features.Fork},
+		{&rc.Features.Search, &override.Features.Search},
+		{&rc.Features.Push, &override.Features.Push},
+		{&rc.Features.Mirrors, &override.Features.Mirrors},
+		{&rc.UploadPack.AllowFilter, &override.UploadPack.AllowFilter},
+		{&rc.UploadPack.AllowReachableSHA1InWant, &override.UploadPack.AllowReachableSHA1InWant},
+		{&rc.UploadPack.AllowAnySHA1InWant, &override.UploadPack.AllowAnySHA1InWant},
+	} {
+		if *f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	return rc
+}
+
+// CloneURL is the URL to clone repo over protocol "http" or "ssh", empty
+// when it isn't offered.
+func (cfg *Config) CloneURL(protocol, repo string) string {
+	rc := cfg.For(repo)
+	var tmpl string
+	switch protocol {
+	case "http":
+		tmpl = rc.Clone.HTTP
+	case "ssh":
+		tmpl = rc.Clone.SSH
+	}
+	t, err := parseCloneTemplate(tmpl)
+	if t == nil || err != nil {
+		return ""
+	}
+	var host string
+	if u, err := url.Parse(cfg.Site.BaseURL); err == nil {
+		host = u.Hostname()
+	}
+	var buf bytes.Buffer
+	t.Execute(&buf, cloneURLData{BaseURL: cfg.Site.BaseURL, Host: host, Repo: repo})
+	return buf.String()
+}
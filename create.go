@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const initialBranch = "main"
+
+var ErrRepositoryExists = errors.New("repository already exists")
+
+// ProjectOptions describes a repository created from /new.
+type ProjectOptions struct {
+	Name        string
+	Description string
+	Owner       string
+	Readme      bool
+	Gitignore   string
+	License     string
+}
+
+// ListInitTemplates returns the names of the embedded files in dir without
+// their extension, e.g. the available licenses.
+func ListInitTemplates(dir string) []string {
+	entries, err := fs.ReadDir(templatefiles, "templates/"+dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readInitTemplate(dir, name, ext string) ([]byte, error) {
+	for _, known := range ListInitTemplates(dir) {
+		if known == name {
+			return fs.ReadFile(templatefiles, "templates/"+dir+"/"+name+ext)
+		}
+	}
+	return nil, fmt.Errorf("unknown %s template %q", dir, name)
+}
+
+func (opts ProjectOptions) initialFiles() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if opts.Readme {
+		readme := "# " + filepath.Base(opts.Name) + "\n"
+		if opts.Description != "" {
+			readme += "\n" + opts.Description + "\n"
+		}
+		files["README.md"] = []byte(readme)
+	}
+	if opts.Gitignore != "" {
+		contents, err := readInitTemplate("gitignore", opts.Gitignore, ".gitignore")
+		if err != nil {
+			return nil, err
+		}
+		files[".gitignore"] = contents
+	}
+	if opts.License != "" {
+		contents, err := readInitTemplate("license", opts.License, ".txt")
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New("license").Parse(string(contents))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = t.Execute(&buf, map[string]any{
+			"Year":  time.Now().Year(),
+			"Owner": opts.Owner,
+		})
+		if err != nil {
+			return nil, err
+		}
+		files["LICENSE"] = buf.Bytes()
+	}
+	return files, nil
+}
+
+// CreateRepository initializes a bare repository below Root and, when any
+// initial files were requested, commits them to the main branch.
+func (sc *Smithy) CreateRepository(opts ProjectOptions) (RepositoryWithName, error) {
+	var rwn RepositoryWithName
+	if err := ValidateRepoName(opts.Name); err != nil {
+		return rwn, err
+	}
+	if err := sc.checkNesting(opts.Name); err != nil {
+		return rwn, err
+	}
+	if _, exists := sc.FindRepo(opts.Name); exists {
+		return rwn, fmt.Errorf("%w: %s", ErrRepositoryExists, opts.Name)
+	}
+	repoPath := filepath.Join(sc.Root, filepath.FromSlash(opts.Name))
+	if _, err := os.Stat(repoPath); err == nil {
+		return rwn, fmt.Errorf("%w: %s", ErrRepositoryExists, opts.Name)
+	}
+	files, err := opts.initialFiles()
+	if err != nil {
+		return rwn, err
+	}
+
+	repo, err := git.PlainInit(repoPath, true)
+	if err != nil {
+		return rwn, err
+	}
+	rwn = RepositoryWithName{Name: opts.Name, Path: repoPath, Repository: repo}
+	err = sc.initRepository(rwn, opts, files)
+	if err != nil {
+		os.RemoveAll(repoPath)
+		return rwn, err
+	}
+	sc.AddRepository(rwn)
+	return rwn, nil
+}
+
+func (sc *Smithy) initRepository(rwn RepositoryWithName, opts ProjectOptions, files map[string][]byte) error {
+	branch := plumbing.NewBranchReferenceName(initialBranch)
+	err := rwn.Repository.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch))
+	if err != nil {
+		return err
+	}
+	if err := rwn.WriteDescription(opts.Description); err != nil {
+		return err
+	}
+	if opts.Owner != "" {
+		if err := rwn.setConfigOption("owner", opts.Owner); err != nil {
+			return err
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	hash, err := commitFiles(rwn.Repository, files, "Initial commit", opts.Owner)
+	if err != nil {
+		return err
+	}
+	return rwn.Repository.Storer.SetReference(plumbing.NewHashReference(branch, hash))
+}
+
+// commitFiles writes a root commit containing files straight into the
+// object store, there is no worktree in a bare repository.
+func commitFiles(repo *git.Repository, files map[string][]byte, message, author string) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	for name, contents := range files {
+		obj := repo.Storer.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, err := obj.Writer()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if _, err := w.Write(contents); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if err := w.Close(); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		hash, err := repo.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: hash})
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool { return tree.Entries[i].Name < tree.Entries[j].Name })
+	treeHash, err := storeObject(repo, tree)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	signature := object.Signature{Name: "Smithy", Email: "smithy@localhost", When: time.Now()}
+	if name, email, ok := strings.Cut(author, "<"); ok {
+		signature.Name = strings.TrimSpace(name)
+		signature.Email = strings.TrimSuffix(strings.TrimSpace(email), ">")
+	} else if author != "" {
+		signature.Name = author
+	}
+	return storeObject(repo, &object.Commit{
+		Author:    signature,
+		Committer: signature,
+		Message:   message + "\n",
+		TreeHash:  treeHash,
+	})
+}
+
+type encoder interface {
+	Encode(plumbing.EncodedObject) error
+}
+
+func storeObject(repo *git.Repository, o encoder) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// The dumb HTTP protocol has clients fetch the files of the repository
+// themselves. Smithy generates the info files git update-server-info would
+// write, so they are never stale, and serves objects and packs from disk.
+
+// writeInfoRefs writes info/refs: every branch and tag, annotated tags
+// followed by the commit they point at.
+func writeInfoRefs(w http.ResponseWriter, repo RepositoryWithName) error {
+	iter, err := repo.Repository.References()
+	if err != nil {
+		return err
+	}
+	var refs []*plumbing.Reference
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && ref.Name() != plumbing.HEAD {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	sort.Sort(ReferenceByName(refs))
+
+	var buf bytes.Buffer
+	for _, ref := range refs {
+		fmt.Fprintf(&buf, "%s\t%s\n", ref.Hash(), ref.Name())
+		if !ref.Name().IsTag() {
+			continue
+		}
+		if tag, err := repo.Repository.TagObject(ref.Hash()); err == nil {
+			if commit, err := tag.Commit(); err == nil {
+				fmt.Fprintf(&buf, "%s\t%s^{}\n", commit.Hash, ref.Name())
+			}
+		}
+	}
+	dumbHeaders(w, "text/plain; charset=utf-8", false)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// dumbHeaders sets the headers git http-backend uses, objects and packs
+// never change under their name.
+func dumbHeaders(w http.ResponseWriter, contentType string, immutable bool) {
+	w.Header().Set("Content-Type", contentType)
+	if immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+	}
+}
+
+func (sc *Smithy) DumbHead(w http.ResponseWriter, r *http.Request) {
+	repo, _ := sc.FindRepo(sc.GetParam(r, "repo"))
+	head, err := repo.Repository.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	dumbHeaders(w, "text/plain", false)
+	if head.Type() == plumbing.SymbolicReference {
+		fmt.Fprintf(w, "ref: %s\n", head.Target())
+	} else {
+		fmt.Fprintf(w, "%s\n", head.Hash())
+	}
+}
+
+// objectDirs is the objects directory of repo followed by the ones it
+// borrows from through alternates. Forks serve the objects of their parent
+// as their own, git only follows alternates on the same path.
+func objectDirs(repo RepositoryWithName) []string {
+	dirs := []string{repo.objectsDir()}
+	for i := 0; i < len(dirs) && i < 5; i++ {
+		b, err := os.ReadFile(filepath.Join(dirs[i], "info", "alternates"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(dirs[i], line)
+			}
+			dirs = append(dirs, filepath.Clean(line))
+		}
+	}
+	return dirs
+}
+
+// DumbInfoPacks lists the packs, objects/info/packs.
+func (sc *Smithy) DumbInfoPacks(w http.ResponseWriter, r *http.Request) {
+	repo, _ := sc.FindRepo(sc.GetParam(r, "repo"))
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	for _, dir := range objectDirs(repo) {
+		packs, _ := filepath.Glob(filepath.Join(dir, "pack", "pack-*.pack"))
+		for _, pack := range packs {
+			if name := filepath.Base(pack); !seen[name] {
+				seen[name] = true
+				fmt.Fprintf(&buf, "P %s\n", name)
+			}
+		}
+	}
+	buf.WriteString("\n")
+	dumbHeaders(w, "text/plain; charset=utf-8", false)
+	buf.WriteTo(w)
+}
+
+func (sc *Smithy) DumbLooseObject(w http.ResponseWriter, r *http.Request) {
+	repo, _ := sc.FindRepo(sc.GetParam(r, "repo"))
+	dumbHeaders(w, "application/x-git-loose-object", true)
+	serveObjectFile(w, r, repo, filepath.Join(sc.GetParam(r, "dir"), sc.GetParam(r, "file")))
+}
+
+func (sc *Smithy) DumbPackFile(w http.ResponseWriter, r *http.Request) {
+	repo, _ := sc.FindRepo(sc.GetParam(r, "repo"))
+	pack := sc.GetParam(r, "pack")
+	contentType := "application/x-git-packed-objects"
+	if strings.HasSuffix(pack, ".idx") {
+		contentType = "application/x-git-packed-objects-toc"
+	}
+	dumbHeaders(w, contentType, true)
+	serveObjectFile(w, r, repo, filepath.Join("pack", pack))
+}
+
+// serveObjectFile serves the first of the object dirs having name, which
+// the route restricted to hex digits.
+func serveObjectFile(w http.ResponseWriter, r *http.Request, repo RepositoryWithName, name string) {
+	for _, dir := range objectDirs(repo) {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+		return
+	}
+	w.Header().Del("Cache-Control")
+	http.NotFound(w, r)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	feedSize = 50
+	// siteFeedPerRepo caps what a busy repository contributes to the site
+	// feed, so one push doesn't crowd out everything else.
+	siteFeedPerRepo = 10
+)
+
+// AtomFeed is an Atom 1.0 document, RFC 4287.
+type AtomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []AtomLink  `xml:"link"`
+	Author   *AtomPerson `xml:"author,omitempty"`
+	Entries  []AtomEntry `xml:"entry"`
+}
+
+type AtomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type AtomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type AtomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type AtomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published,omitempty"`
+	Links     []AtomLink `xml:"link"`
+	Author    AtomPerson `xml:"author"`
+	Content   *AtomText  `xml:"content,omitempty"`
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// newFeed starts a feed served at feedPath about the page at pagePath.
+func (sc *Smithy) newFeed(title, feedPath, pagePath string) *AtomFeed {
+	base := sc.Config().Site.BaseURL
+	return &AtomFeed{
+		Title: title,
+		ID:    base + feedPath,
+		Links: []AtomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + feedPath},
+			{Rel: "alternate", Type: "text/html", Href: base + pagePath},
+		},
+	}
+}
+
+// commitEntry is a commit with its full message, the author is who wrote
+// the change and updated when it was committed.
+func (sc *Smithy) commitEntry(repoName string, commit *object.Commit, title string) AtomEntry {
+	href := sc.Config().Site.BaseURL + "/" + repoName + "/commit/" + commit.Hash.String()
+	entry := AtomEntry{
+		Title:     title,
+		ID:        href,
+		Updated:   atomTime(commit.Committer.When),
+		Published: atomTime(commit.Author.When),
+		Links:     []AtomLink{{Rel: "alternate", Type: "text/html", Href: href}},
+		Author:    AtomPerson{Name: commit.Author.Name, Email: commit.Author.Email},
+	}
+	if body := strings.TrimSpace(commit.Message); body != "" {
+		entry.Content = &AtomText{Type: "text", Body: body}
+	}
+	return entry
+}
+
+// finish sets the updated time of the feed to that of its newest entry.
+// Entries are expected newest first.
+func (feed *AtomFeed) finish(fallback time.Time) {
+	if len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	} else {
+		feed.Updated = atomTime(fallback)
+	}
+}
+
+func (sc *Smithy) writeFeed(w http.ResponseWriter, feed *AtomFeed) {
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
+
+// recentCommits returns up to limit commits reachable from rev, newest
+// first.
+func recentCommits(repo *git.Repository, rev string, limit int) ([]*object.Commit, error) {
+	hash, err := ResolveRevision(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.Log(&git.LogOptions{From: *hash, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	var commits []*object.Commit
+	for len(commits) < limit {
+		commit, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return commits, err
+		}
+		commits = append(commits, commit)
+	}
+	return commits, nil
+}
+
+// LogFeed is the commit log of a branch, the main branch when no ref is
+// given.
+func (sc *Smithy) LogFeed(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	refName := sc.GetParam(r, "ref")
+	if refName == "" {
+		var err error
+		refName, _, err = sc.MainBranch(repo)
+		if errors.Is(err, ErrEmptyRepository) {
+			feed := sc.newFeed(repoName, "/"+repoName+"/log.atom", "/"+repoName)
+			feed.finish(time.Now())
+			sc.writeFeed(w, feed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	commits, err := recentCommits(repo.Repository, refName, feedSize)
+	if err != nil && commits == nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	feed := sc.newFeed(repoName+": "+refName, "/"+repoName+"/log/"+refName+".atom", "/"+repoName+"/log/"+refName)
+	feed.Subtitle = repo.ReadDescription()
+	for _, commit := range commits {
+		feed.Entries = append(feed.Entries, sc.commitEntry(repoName, commit, strings.Split(commit.Message, "\n")[0]))
+	}
+	feed.finish(time.Now())
+	sc.writeFeed(w, feed)
+}
+
+// TagsFeed lists the tags, newest first. Annotated tags are attributed to
+// the tagger and carry their message.
+func (sc *Smithy) TagsFeed(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	tags, err := ListTagDetails(repo.Repository)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Stable(TagsByDate(tags))
+
+	feed := sc.newFeed(repoName+": tags", "/"+repoName+"/tags.atom", "/"+repoName+"/refs")
+	base := sc.Config().Site.BaseURL
+	for _, t := range tags {
+		if len(feed.Entries) == feedSize {
+			break
+		}
+		name := t.Reference.Name().Short()
+		href := base + "/" + repoName + "/tree/" + name
+		entry := AtomEntry{
+			Title:   repoName + " " + name,
+			ID:      base + "/" + repoName + "/" + t.Reference.Name().String() + "@" + t.Reference.Hash().String(),
+			Updated: atomTime(t.Date()),
+			Links:   []AtomLink{{Rel: "alternate", Type: "text/html", Href: href}},
+		}
+		switch {
+		case t.Object != nil:
+			entry.Author = AtomPerson{Name: t.Object.Tagger.Name, Email: t.Object.Tagger.Email}
+		case t.Commit != nil:
+			entry.Author = AtomPerson{Name: t.Commit.Author.Name, Email: t.Commit.Author.Email}
+		default:
+			entry.Author = AtomPerson{Name: "unknown"}
+		}
+		message := t.Message()
+		if message == "" && t.Commit != nil {
+			message = strings.TrimSpace(t.Commit.Message)
+		}
+		if message != "" {
+			entry.Content = &AtomText{Type: "text", Body: message}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	feed.finish(time.Now())
+	sc.writeFeed(w, feed)
+}
+
+// SiteFeed is the recent activity across the listed repositories: the
+// latest commits on their main branches.
+func (sc *Smithy) SiteFeed(w http.ResponseWriter, r *http.Request) {
+	site := sc.Config().Site
+	feed := sc.newFeed(site.Name, "/feed.atom", "/")
+	feed.Subtitle = site.Description
+	if site.Author != "" {
+		feed.Author = &AtomPerson{Name: site.Author, Email: site.Email}
+	}
+
+	type repoCommit struct {
+		repo   string
+		commit *object.Commit
+	}
+	var recent []repoCommit
+	for _, repo := range sc.GetRepositories() {
+		if repo.IsUnlisted() {
+			continue
+		}
+		branch, _, err := sc.MainBranch(repo)
+		if err != nil {
+			continue
+		}
+		commits, _ := recentCommits(repo.Repository, branch, siteFeedPerRepo)
+		for _, commit := range commits {
+			recent = append(recent, repoCommit{repo.Name, commit})
+		}
+	}
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].commit.Committer.When.After(recent[j].commit.Committer.When)
+	})
+	if len(recent) > feedSize {
+		recent = recent[:feedSize]
+	}
+	for _, rc := range recent {
+		title := rc.repo + ": " + strings.Split(rc.commit.Message, "\n")[0]
+		feed.Entries = append(feed.Entries, sc.commitEntry(rc.repo, rc.commit, title))
+	}
+	feed.finish(time.Now())
+	sc.writeFeed(w, feed)
+}
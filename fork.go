@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// alternatesFile lists the object directories a repository borrows from.
+func (rwn RepositoryWithName) alternatesFile() string {
+	return filepath.Join(rwn.GitDir(), "objects", "info", "alternates")
+}
+
+func (rwn RepositoryWithName) objectsDir() string {
+	return filepath.Join(rwn.GitDir(), "objects")
+}
+
+// ForkOf returns the name of the repository rwn was forked from.
+func (rwn RepositoryWithName) ForkOf() string {
+	return rwn.configOption("forkof")
+}
+
+// Forks lists the repositories forked from rwn.
+func (sc *Smithy) Forks(rwn RepositoryWithName) []RepositoryWithName {
+	var forks []RepositoryWithName
+	for _, repo := range sc.GetRepositories() {
+		if repo.ForkOf() == rwn.Name {
+			forks = append(forks, repo)
+		}
+	}
+	sort.Sort(RepositoryByName(forks))
+	return forks
+}
+
+// ForkRepository creates name as a bare copy of parent. The fork has its own
+// refs but borrows the objects of parent through objects/info/alternates, so
+// objects must never be pruned from a repository with forks.
+func (sc *Smithy) ForkRepository(parent RepositoryWithName, name string) (RepositoryWithName, error) {
+	var rwn RepositoryWithName
+	if err := ValidateRepoName(name); err != nil {
+		return rwn, err
+	}
+	if err := sc.checkNesting(name); err != nil {
+		return rwn, err
+	}
+	if _, exists := sc.FindRepo(name); exists {
+		return rwn, fmt.Errorf("%w: %s", ErrRepositoryExists, name)
+	}
+	repoPath := filepath.Join(sc.Root, filepath.FromSlash(name))
+	if _, err := os.Stat(repoPath); err == nil {
+		return rwn, fmt.Errorf("%w: %s", ErrRepositoryExists, name)
+	}
+
+	repo, err := git.PlainInit(repoPath, true)
+	if err != nil {
+		return rwn, err
+	}
+	rwn = RepositoryWithName{Name: name, Path: repoPath, Repository: repo}
+	if err := initFork(rwn, parent); err != nil {
+		os.RemoveAll(repoPath)
+		return rwn, err
+	}
+	// Reopen so the object storage picks up the alternates.
+	if rwn.Repository, err = git.PlainOpen(repoPath); err != nil {
+		os.RemoveAll(repoPath)
+		return rwn, err
+	}
+	sc.AddRepository(rwn)
+	return rwn, nil
+}
+
+func initFork(fork, parent RepositoryWithName) error {
+	objects, err := filepath.Abs(parent.objectsDir())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fork.alternatesFile(), []byte(objects+"\n"), 0644); err != nil {
+		return err
+	}
+
+	iter, err := parent.Repository.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if !ref.Name().IsBranch() && !ref.Name().IsTag() {
+			return nil
+		}
+		return fork.Repository.Storer.SetReference(ref)
+	})
+	if err != nil {
+		return err
+	}
+	if head, err := parent.Repository.Storer.Reference(plumbing.HEAD); err == nil {
+		if err := fork.Repository.Storer.SetReference(head); err != nil {
+			return err
+		}
+	}
+
+	if err := linkLFSObjects(fork, parent); err != nil {
+		return err
+	}
+	if err := fork.WriteDescription(parent.ReadDescription()); err != nil {
+		return err
+	}
+	// The fork serves the objects of a private parent, it starts private.
+	if parent.IsPrivate() {
+		if err := fork.SetVisibility(VisibilityPrivate); err != nil {
+			return err
+		}
+	}
+	return fork.setConfigOption("forkof", parent.Name)
+}
+
+// listedForks are the forks shown on the page of rwn, without the unlisted
+// ones.
+func (sc *Smithy) listedForks(rwn RepositoryWithName) []RepositoryWithName {
+	var forks []RepositoryWithName
+	for _, fork := range sc.Forks(rwn) {
+		if !fork.IsUnlisted() {
+			forks = append(forks, fork)
+		}
+	}
+	return forks
+}
+
+// relinkForks points the forks of a renamed repository at its new location.
+func (sc *Smithy) relinkForks(oldName string, renamed RepositoryWithName) error {
+	objects, err := filepath.Abs(renamed.objectsDir())
+	if err != nil {
+		return err
+	}
+	for _, fork := range sc.GetRepositories() {
+		if fork.ForkOf() != oldName {
+			continue
+		}
+		if err := os.WriteFile(fork.alternatesFile(), []byte(objects+"\n"), 0644); err != nil {
+			return err
+		}
+		if err := fork.setConfigOption("forkof", renamed.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detachForks gives every fork of rwn a full copy of the objects it
+// borrows, before rwn goes away.
+func (sc *Smithy) detachForks(rwn RepositoryWithName) error {
+	for _, fork := range sc.GetRepositories() {
+		if fork.ForkOf() != rwn.Name {
+			continue
+		}
+		if err := copyBorrowedObjects(fork); err != nil {
+			return fmt.Errorf("copying objects to %s: %v", fork.Name, err)
+		}
+		if err := os.Remove(fork.alternatesFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := fork.setConfigOption("forkof", ""); err != nil {
+			return err
+		}
+		r, err := git.PlainOpen(fork.Path)
+		if err != nil {
+			return err
+		}
+		fork.Repository = r
+		sc.AddRepository(fork)
+	}
+	return nil
+}
+
+// copyBorrowedObjects writes everything the refs of fork reach into a pack
+// of its own, like git repack -a does. Objects it already has are copied
+// again, they are dropped by the next gc.
+func copyBorrowedObjects(fork RepositoryWithName) error {
+	var tips []plumbing.Hash
+	iter, err := fork.Repository.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			tips = append(tips, ref.Hash())
+		}
+		return nil
+	})
+	hashes, err := revlist.Objects(fork.Repository.Storer, tips, nil)
+	if err != nil || len(hashes) == 0 {
+		return err
+	}
+	pw, ok := fork.Repository.Storer.(storer.PackfileWriter)
+	if !ok {
+		return errors.New("storage can't write packs")
+	}
+	w, err := pw.PackfileWriter()
+	if err != nil {
+		return err
+	}
+	enc := packfile.NewEncoder(w, alternatesStorer{fork.Repository.Storer}, false)
+	if _, err := enc.Encode(hashes, 10); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// CompareSide is one end of a comparison, a revision in a repository.
+type CompareSide struct {
+	Repo     RepositoryWithName
+	Revision string
+	Commit   *object.Commit
+}
+
+// Label is how the side is written in a compare URL, with the repository
+// prepended when it isn't the one being viewed.
+func (cs CompareSide) Label(current string) string {
+	if cs.Repo.Name == current {
+		return cs.Revision
+	}
+	return cs.Repo.Name + ":" + cs.Revision
+}
+
+// ErrSiblingForks is returned for comparisons between two forks of the same
+// repository, neither can see the objects of the other.
+var ErrSiblingForks = errors.New("forks of the same repository can't be compared, compare each with the parent")
+
+type Comparison struct {
+	Base, Head CompareSide
+	MergeBase  *object.Commit
+	Commits    []*object.Commit
+	Changes    object.Changes
+}
+
+// ParseCompareSide resolves [repo:]revision, repo defaulting to current.
+// Only current, its parent and its forks can be compared with it.
+func (sc *Smithy) ParseCompareSide(current RepositoryWithName, s string) (CompareSide, error) {
+	side := CompareSide{Repo: current, Revision: s}
+	if name, rev, ok := strings.Cut(s, ":"); ok && name != current.Name {
+		repo, exists := sc.FindRepo(name)
+		if !exists {
+			return side, fmt.Errorf("repository %s not found", name)
+		}
+		if repo.Name != current.ForkOf() && repo.ForkOf() != current.Name {
+			return side, fmt.Errorf("%s is not a fork or the parent of %s", repo.Name, current.Name)
+		}
+		side.Repo, side.Revision = repo, rev
+	} else if ok {
+		side.Revision = rev
+	}
+	hash, err := ResolveRevision(side.Repo.Repository, side.Revision)
+	if err != nil {
+		return side, fmt.Errorf("%s: %w", s, err)
+	}
+	side.Commit, err = side.Repo.Repository.CommitObject(*hash)
+	return side, err
+}
+
+// Compare lists the commits of head missing from base and their changes
+// since the merge base, like git diff base...head.
+func Compare(base, head CompareSide, limit int) (*Comparison, error) {
+	if base.Repo.Name != head.Repo.Name && base.Repo.ForkOf() != head.Repo.Name &&
+		head.Repo.ForkOf() != base.Repo.Name {
+		return nil, ErrSiblingForks
+	}
+	// A fork sees the objects of its parent but not the other way around,
+	// so work in the fork when the sides live in different repositories.
+	repo := head.Repo.Repository
+	if base.Repo.ForkOf() == head.Repo.Name {
+		repo = base.Repo.Repository
+	}
+	baseCommit, err := repo.CommitObject(base.Commit.Hash)
+	if err != nil {
+		return nil, err
+	}
+	headCommit, err := repo.CommitObject(head.Commit.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Comparison{Base: base, Head: head}
+	bases, err := baseCommit.MergeBase(headCommit)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 0 {
+		return nil, errors.New("the revisions have no common history")
+	}
+	c.MergeBase = bases[0]
+
+	iter := object.NewCommitIterCTime(headCommit, nil, []plumbing.Hash{c.MergeBase.Hash})
+	defer iter.Close()
+	for len(c.Commits) < limit {
+		commit, err := iter.Next()
+		if err != nil {
+			break
+		}
+		c.Commits = append(c.Commits, commit)
+	}
+
+	fromTree, err := c.MergeBase.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := headCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	c.Changes, err = object.DiffTree(fromTree, toTree)
+	return c, err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestDeleteParentDetachesForks(t *testing.T) {
+	sc := newTestSmithy(t)
+	parentPath := filepath.Join(sc.Root, "parent")
+	repo, err := git.PlainInit(parentPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, repo, "README", "one\n")
+	head := commitFile(t, repo, "README", "two\n")
+	parent := RepositoryWithName{Name: "parent", Path: parentPath, Repository: repo}
+	sc.AddRepository(parent)
+
+	fork, err := sc.ForkRepository(parent, "fork.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fork.alternatesFile()); err != nil {
+		t.Fatalf("fork doesn't borrow objects: %v", err)
+	}
+
+	if err := sc.DeleteRepository("parent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fork.alternatesFile()); !os.IsNotExist(err) {
+		t.Fatalf("alternates left behind: %v", err)
+	}
+	r, err := git.PlainOpen(fork.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := r.CommitObject(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = object.NewCommitPreorderIter(commit, nil, nil).ForEach(func(c *object.Commit) error {
+		n++
+		_, err := c.Files()
+		return err
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("history of the fork: %d commits, %v", n, err)
+	}
+	if detached, _ := sc.FindRepo("fork.git"); detached.ForkOf() != "" {
+		t.Fatalf("still a fork of %s", detached.ForkOf())
+	}
+}
+
+func TestCompareSiblingForks(t *testing.T) {
+	sc := newTestSmithy(t)
+	parentPath := filepath.Join(sc.Root, "parent")
+	repo, err := git.PlainInit(parentPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, repo, "README", "one\n")
+	parent := RepositoryWithName{Name: "parent", Path: parentPath, Repository: repo}
+	sc.AddRepository(parent)
+	for _, name := range []string{"a.git", "b.git"} {
+		if _, err := sc.ForkRepository(parent, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	base, err := sc.ParseCompareSide(parent, "a.git:HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := sc.ParseCompareSide(parent, "b.git:HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compare(base, head, 10); err != ErrSiblingForks {
+		t.Fatalf("compared siblings: %v", err)
+	}
+	main, err := sc.ParseCompareSide(parent, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compare(main, head, 10); err != nil {
+		t.Fatal(err)
+	}
+}
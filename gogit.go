@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+)
+
+// The go backend speaks the smart HTTP protocol with the server of go-git
+// instead of running git, so Smithy runs where git isn't installed.
+//
+// go-git advertises the refs and receives pushes. Fetches are answered
+// here: over stateless HTTP the client negotiates in several requests, in
+// the multi_ack_detailed style git clients expect, and the pack is picked
+// in gopack.go, which knows shallow and filtered histories.
+
+const (
+	GitBackendExec = "git"
+	GitBackendGo   = "go"
+)
+
+// noThin asks pushing clients not to send thin packs, go-git has no
+// constant for it.
+const noThin capability.Capability = "no-thin"
+
+// repoLoader hands go-git the storage of an already open repository.
+type repoLoader struct {
+	storer storer.Storer
+}
+
+func (l repoLoader) Load(*transport.Endpoint) (storer.Storer, error) {
+	return l.storer, nil
+}
+
+// goEndpoint is required by the transport API, the loader ignores it.
+var goEndpoint = &transport.Endpoint{Protocol: "file", Path: "/"}
+
+func goServer(repo RepositoryWithName) transport.Transport {
+	return server.NewServer(repoLoader{repo.Repository.Storer})
+}
+
+// alternatesStorer looks up the objects a fork borrows from its parent,
+// the DeltaObject of go-git only searches the repository itself. Pushes
+// get the plain storer, which writes the pack as a whole.
+type alternatesStorer struct {
+	storer.Storer
+}
+
+func (s alternatesStorer) DeltaObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if ds, ok := s.Storer.(storer.DeltaObjectStorer); ok {
+		obj, err := ds.DeltaObject(t, h)
+		if err != plumbing.ErrObjectNotFound {
+			return obj, err
+		}
+	}
+	return s.Storer.EncodedObject(t, h)
+}
+
+func goUploadServer(repo RepositoryWithName) transport.Transport {
+	return server.NewServer(repoLoader{alternatesStorer{repo.Repository.Storer}})
+}
+
+// goAdvertiseRefs writes the refs and capabilities of service, after the
+// service line the handler wrote.
+func goAdvertiseRefs(ctx context.Context, w io.Writer, repo RepositoryWithName, service string, opts UploadPack) error {
+	var ar *packp.AdvRefs
+	switch service {
+	case "git-upload-pack":
+		sess, err := goUploadServer(repo).NewUploadPackSession(goEndpoint, nil)
+		if err != nil {
+			return err
+		}
+		if ar, err = sess.AdvertisedReferencesContext(ctx); err != nil {
+			return err
+		}
+		for _, c := range []capability.Capability{
+			capability.MultiACKDetailed, capability.Shallow, capability.DeepenSince, capability.DeepenNot,
+		} {
+			ar.Capabilities.Add(c)
+		}
+		if opts.FilterAllowed() {
+			ar.Capabilities.Add(capability.Filter)
+		}
+		if opts.ReachableSHA1InWantAllowed() {
+			ar.Capabilities.Add(capability.AllowTipSHA1InWant)
+			ar.Capabilities.Add(capability.AllowReachableSHA1InWant)
+		}
+	case "git-receive-pack":
+		sess, err := goServer(repo).NewReceivePackSession(goEndpoint, nil)
+		if err != nil {
+			return err
+		}
+		if ar, err = sess.AdvertisedReferencesContext(ctx); err != nil {
+			return err
+		}
+		// go-git can't resolve deltas against objects outside the pack,
+		// clients have to send complete packs.
+		ar.Capabilities.Add(noThin)
+	default:
+		return fmt.Errorf("unsupported service %s", service)
+	}
+	return ar.Encode(w)
+}
+
+// goUploadPack answers one request of a fetch. Haves without done are a
+// negotiation round: the commits known here are acknowledged as common and
+// the client comes back with more haves or done. Requests that deepen a
+// shallow history get the shallow commits first, every round.
+func goUploadPack(ctx context.Context, w io.Writer, repo RepositoryWithName, body io.Reader, opts UploadPack) error {
+	req, err := decodeUploadRequest(body)
+	if err == nil {
+		err = checkUploadRequest(repo, req, opts)
+	}
+	if err != nil {
+		return reportError(w, err)
+	}
+	haves, done, err := decodeHaves(body)
+	if err != nil {
+		return reportError(w, err)
+	}
+	// Only what is here limits the pack.
+	var common []plumbing.Hash
+	for _, have := range haves {
+		if _, err := repo.Repository.Storer.EncodedObject(plumbing.AnyObject, have); err == nil {
+			common = append(common, have)
+		}
+	}
+
+	shallow, err := computeShallow(repo.Repository.Storer, repo.Repository.Storer, req)
+	if err != nil {
+		return reportError(w, err)
+	}
+	if req.deepens() {
+		if err := shallow.encode(w); err != nil {
+			return err
+		}
+	}
+
+	e := pktline.NewEncoder(w)
+	if !done {
+		// A deepening client asks for the shallow commits alone first.
+		if len(haves) == 0 && req.deepens() {
+			return nil
+		}
+		for _, hash := range common {
+			if err := e.Encodef("ACK %s common\n", hash); err != nil {
+				return err
+			}
+		}
+		return e.Encodef("NAK\n")
+	}
+
+	objects, err := objectsToUpload(repo.Repository.Storer, req, common, shallow)
+	if err != nil {
+		return reportError(w, err)
+	}
+	if len(common) > 0 {
+		err = e.Encodef("ACK %s\n", common[len(common)-1])
+	} else {
+		err = e.Encodef("NAK\n")
+	}
+	if err != nil {
+		return err
+	}
+	enc := packfile.NewEncoder(w, alternatesStorer{repo.Repository.Storer}, false)
+	_, err = enc.Encode(objects, 10)
+	return err
+}
+
+// checkUploadRequest refuses what the options of the repository don't
+// allow.
+func checkUploadRequest(repo RepositoryWithName, req *uploadRequest, opts UploadPack) error {
+	if req.Filter.Set && !opts.FilterAllowed() {
+		return errors.New("filters are not allowed")
+	}
+	if opts.AnySHA1InWantAllowed() {
+		return nil
+	}
+	return checkWants(repo, req.Wants, opts.ReachableSHA1InWantAllowed())
+}
+
+// reportError sends err to the client, git prints it as a remote error.
+func reportError(w io.Writer, err error) error {
+	pktline.NewEncoder(w).Encodef("ERR %s\n", err)
+	return err
+}
+
+// checkWants accepts the tips of refs and the commits they reach, like git
+// does over stateless HTTP without uploadpack.allowAnySHA1InWant. With
+// reachable wants the trees and blobs of those commits are accepted too.
+func checkWants(repo RepositoryWithName, wants []plumbing.Hash, reachableObjects bool) error {
+	var tips []*object.Commit
+	var tipHashes []plumbing.Hash
+	isTip := make(map[plumbing.Hash]bool)
+	iter, err := repo.Repository.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		isTip[ref.Hash()] = true
+		tipHashes = append(tipHashes, ref.Hash())
+		if commit, err := object.GetCommit(repo.Repository.Storer, ref.Hash()); err == nil {
+			tips = append(tips, commit)
+		}
+		return nil
+	})
+	var rest []plumbing.Hash
+	for _, want := range wants {
+		if !isTip[want] && !reachable(repo, want, tips) {
+			rest = append(rest, want)
+		}
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	if !reachableObjects {
+		return fmt.Errorf("not our ref %s", rest[0])
+	}
+	// Walking every object is expensive, it is left for wants that aren't
+	// commits, the blobs a partial clone fetches later.
+	all := newObjectWalker(repo.Repository.Storer, nil, nil, objectFilter{})
+	for _, hash := range tipHashes {
+		if err := all.walk(hash); err != nil {
+			return err
+		}
+	}
+	for _, want := range rest {
+		if !all.seen[want] {
+			return fmt.Errorf("not our ref %s", want)
+		}
+	}
+	return nil
+}
+
+func reachable(repo RepositoryWithName, hash plumbing.Hash, tips []*object.Commit) bool {
+	commit, err := object.GetCommit(repo.Repository.Storer, hash)
+	if err != nil {
+		return false
+	}
+	for _, tip := range tips {
+		if ok, _ := commit.IsAncestor(tip); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeHaves reads the have lines following the wants of an upload-pack
+// request, up to a flush or done.
+func decodeHaves(r io.Reader) (haves []plumbing.Hash, done bool, err error) {
+	s := pktline.NewScanner(r)
+	for s.Scan() {
+		line := bytes.TrimSuffix(s.Bytes(), []byte("\n"))
+		switch {
+		case len(line) == 0:
+			continue
+		case bytes.Equal(line, []byte("done")):
+			return haves, true, nil
+		case bytes.HasPrefix(line, []byte("have ")) && len(line) == 45:
+			haves = append(haves, plumbing.NewHash(string(line[5:])))
+		default:
+			return nil, false, fmt.Errorf("unexpected line %q", line)
+		}
+	}
+	return haves, false, s.Err()
+}
+
+// goReceivePack stores a pushed pack and updates the refs.
+func goReceivePack(ctx context.Context, w io.Writer, repo RepositoryWithName, body io.Reader) error {
+	body, err := checkPushShallows(repo, body)
+	if err != nil {
+		return reportError(w, err)
+	}
+	req := packp.NewReferenceUpdateRequest()
+	if err := req.Decode(body); err != nil {
+		return err
+	}
+	// A push only deleting refs comes without a pack.
+	br := bufio.NewReader(req.Packfile)
+	if _, err := br.Peek(1); err == io.EOF {
+		req.Packfile = nil
+	} else {
+		req.Packfile = io.NopCloser(br)
+	}
+	sess, err := goServer(repo).NewReceivePackSession(goEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	status, err := sess.ReceivePack(ctx, req)
+	if status != nil {
+		return status.Encode(w)
+	}
+	return err
+}
+
+// checkPushShallows reads the shallow commits a shallow clone sends ahead
+// of its ref updates, go-git can't parse them. The push is refused unless
+// they are here, like git does without receive.shallowUpdate, so the pushed
+// history stays connected.
+func checkPushShallows(repo RepositoryWithName, body io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(body)
+	for {
+		head, err := br.Peek(4)
+		if err != nil {
+			return br, nil
+		}
+		n, err := strconv.ParseUint(string(head), 16, 16)
+		if err != nil || n <= 4 {
+			return br, nil
+		}
+		line, err := br.Peek(int(n))
+		if err != nil || !bytes.HasPrefix(line[4:], []byte("shallow ")) {
+			return br, nil
+		}
+		hash := strings.TrimSpace(string(line[4+len("shallow "):]))
+		if !plumbing.IsHash(hash) {
+			return nil, fmt.Errorf("invalid shallow %q", hash)
+		}
+		if _, err := repo.Repository.CommitObject(plumbing.NewHash(hash)); err != nil {
+			return nil, errors.New("shallow update not allowed")
+		}
+		br.Discard(int(n))
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// The go backend picks the objects of a fetch itself: the server of go-git
+// has neither shallow nor filtered packs.
+
+// uploadRequest is what a fetch asks for, the lines up to the first flush.
+type uploadRequest struct {
+	Wants        []plumbing.Hash
+	Capabilities *capability.List
+	// Shallows are the commits the client has without their parents.
+	Shallows    []plumbing.Hash
+	Depth       int
+	DeepenSince time.Time
+	DeepenNot   []string
+	Filter      objectFilter
+}
+
+// deepens reports whether the client asked for a shallow history.
+func (req *uploadRequest) deepens() bool {
+	return req.Depth > 0 || !req.DeepenSince.IsZero() || len(req.DeepenNot) > 0
+}
+
+func decodeUploadRequest(r io.Reader) (*uploadRequest, error) {
+	req := &uploadRequest{Capabilities: capability.NewList()}
+	s := pktline.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSuffix(string(s.Bytes()), "\n")
+		if line == "" {
+			break
+		}
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "want":
+			hash, caps, _ := strings.Cut(value, " ")
+			if len(req.Wants) == 0 && caps != "" {
+				err = req.Capabilities.Decode([]byte(caps))
+			}
+			if !plumbing.IsHash(hash) {
+				err = fmt.Errorf("invalid want %q", value)
+			}
+			req.Wants = append(req.Wants, plumbing.NewHash(hash))
+		case "shallow":
+			if !plumbing.IsHash(value) {
+				err = fmt.Errorf("invalid shallow %q", value)
+			}
+			req.Shallows = append(req.Shallows, plumbing.NewHash(value))
+		case "deepen":
+			req.Depth, err = strconv.Atoi(value)
+			if err == nil && req.Depth <= 0 {
+				err = fmt.Errorf("invalid depth %d", req.Depth)
+			}
+		case "deepen-since":
+			var secs int64
+			secs, err = strconv.ParseInt(value, 10, 64)
+			req.DeepenSince = time.Unix(secs, 0)
+		case "deepen-not":
+			req.DeepenNot = append(req.DeepenNot, value)
+		case "filter":
+			req.Filter, err = parseObjectFilter(value)
+		default:
+			err = fmt.Errorf("unexpected line %q", line)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(req.Wants) == 0 {
+		return nil, errors.New("no wants")
+	}
+	if req.Depth > 0 && (!req.DeepenSince.IsZero() || len(req.DeepenNot) > 0) {
+		return nil, errors.New("deepen and deepen-since (or deepen-not) cannot be used together")
+	}
+	return req, nil
+}
+
+// objectFilter leaves blobs out of the pack of a partial clone, all of them
+// or those of Limit bytes and more.
+type objectFilter struct {
+	Set   bool
+	Limit int64
+}
+
+// parseObjectFilter understands blob:none and blob:limit=<n>[kmg].
+func parseObjectFilter(spec string) (objectFilter, error) {
+	if spec == "blob:none" {
+		return objectFilter{Set: true}, nil
+	}
+	limit, ok := strings.CutPrefix(spec, "blob:limit=")
+	if !ok || limit == "" {
+		return objectFilter{}, fmt.Errorf("filter %q is not supported", spec)
+	}
+	unit := int64(1)
+	switch limit[len(limit)-1] {
+	case 'k':
+		unit = 1 << 10
+	case 'm':
+		unit = 1 << 20
+	case 'g':
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		limit = limit[:len(limit)-1]
+	}
+	n, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil || n < 0 {
+		return objectFilter{}, fmt.Errorf("filter %q is not supported", spec)
+	}
+	return objectFilter{Set: true, Limit: n * unit}, nil
+}
+
+// shallowUpdate is the answer to a request that deepens, the commits that
+// become shallow on the client and those that aren't anymore.
+type shallowUpdate struct {
+	Shallow   []plumbing.Hash
+	Unshallow []plumbing.Hash
+}
+
+func (su shallowUpdate) encode(w io.Writer) error {
+	e := pktline.NewEncoder(w)
+	for _, hash := range su.Shallow {
+		if err := e.Encodef("shallow %s\n", hash); err != nil {
+			return err
+		}
+	}
+	for _, hash := range su.Unshallow {
+		if err := e.Encodef("unshallow %s\n", hash); err != nil {
+			return err
+		}
+	}
+	return e.Flush()
+}
+
+// shallowCut is where the history sent to the client ends.
+type shallowCut struct {
+	shallowUpdate
+	// cut are the commits whose parents aren't sent.
+	cut map[plumbing.Hash]bool
+	// parents of unshallowed commits are sent like wants.
+	parents []plumbing.Hash
+}
+
+// computeShallow finds the commits the history sent for req is cut at. The
+// shallow commits of the client stay shallow unless req deepens past them.
+func computeShallow(s storer.EncodedObjectStorer, refs storer.ReferenceStorer, req *uploadRequest) (*shallowCut, error) {
+	sc := &shallowCut{cut: make(map[plumbing.Hash]bool)}
+	client := make(map[plumbing.Hash]bool)
+	for _, hash := range req.Shallows {
+		client[hash] = true
+	}
+	if !req.deepens() {
+		sc.cut = client
+		return sc, nil
+	}
+
+	var wants []*object.Commit
+	for _, want := range req.Wants {
+		if commit, err := peelCommit(s, want); err == nil {
+			wants = append(wants, commit)
+		}
+	}
+	// window holds the commits sent, boundary those sent without parents.
+	window := make(map[plumbing.Hash]bool)
+	boundary := make(map[plumbing.Hash]bool)
+	var err error
+	if req.Depth > 0 {
+		err = depthWindow(s, wants, req.Depth, window, boundary)
+	} else {
+		err = rangeWindow(s, refs, wants, req, window, boundary)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for hash := range boundary {
+		sc.cut[hash] = true
+		if !client[hash] {
+			sc.Shallow = append(sc.Shallow, hash)
+		}
+	}
+	for hash := range client {
+		if !window[hash] || boundary[hash] {
+			sc.cut[hash] = true
+			continue
+		}
+		commit, err := object.GetCommit(s, hash)
+		if err != nil {
+			return nil, err
+		}
+		sc.Unshallow = append(sc.Unshallow, hash)
+		sc.parents = append(sc.parents, commit.ParentHashes...)
+	}
+	return sc, nil
+}
+
+// depthWindow takes depth commits from each want, the first counting as one.
+func depthWindow(s storer.EncodedObjectStorer, wants []*object.Commit, depth int, window, boundary map[plumbing.Hash]bool) error {
+	level := wants
+	for d := 1; len(level) > 0; d++ {
+		var next []*object.Commit
+		for _, commit := range level {
+			if window[commit.Hash] {
+				continue
+			}
+			window[commit.Hash] = true
+			if d == depth {
+				if commit.NumParents() > 0 {
+					boundary[commit.Hash] = true
+				}
+				continue
+			}
+			for _, parent := range commit.ParentHashes {
+				p, err := object.GetCommit(s, parent)
+				if err != nil {
+					return err
+				}
+				next = append(next, p)
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
+// rangeWindow takes the commits of the wants newer than deepen-since and
+// not reachable from the deepen-not refs.
+func rangeWindow(s storer.EncodedObjectStorer, refs storer.ReferenceStorer, wants []*object.Commit, req *uploadRequest, window, boundary map[plumbing.Hash]bool) error {
+	excluded := make(map[plumbing.Hash]bool)
+	for _, name := range req.DeepenNot {
+		ref, err := resolveDeepenNot(refs, name)
+		if err != nil {
+			return err
+		}
+		commit, err := peelCommit(s, ref.Hash())
+		if err != nil {
+			return err
+		}
+		err = object.NewCommitPreorderIter(commit, excluded, nil).ForEach(func(c *object.Commit) error {
+			excluded[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	selected := func(c *object.Commit) bool {
+		return !excluded[c.Hash] && !c.Committer.When.Before(req.DeepenSince)
+	}
+
+	var stack []*object.Commit
+	for _, want := range wants {
+		if selected(want) {
+			stack = append(stack, want)
+		}
+	}
+	if len(stack) == 0 {
+		return errors.New("no commits selected for shallow requests")
+	}
+	for len(stack) > 0 {
+		commit := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if window[commit.Hash] {
+			continue
+		}
+		window[commit.Hash] = true
+		for _, parent := range commit.ParentHashes {
+			p, err := object.GetCommit(s, parent)
+			if err != nil {
+				return err
+			}
+			if selected(p) {
+				stack = append(stack, p)
+			} else {
+				boundary[commit.Hash] = true
+			}
+		}
+	}
+	return nil
+}
+
+// resolveDeepenNot finds the ref of deepen-not, given in full or short.
+func resolveDeepenNot(refs storer.ReferenceStorer, name string) (*plumbing.Reference, error) {
+	for _, rule := range plumbing.RefRevParseRules {
+		ref, err := storer.ResolveReference(refs, plumbing.ReferenceName(fmt.Sprintf(rule, name)))
+		if err == nil {
+			return ref, nil
+		}
+	}
+	return nil, fmt.Errorf("deepen-not %s is not a ref", name)
+}
+
+func peelCommit(s storer.EncodedObjectStorer, hash plumbing.Hash) (*object.Commit, error) {
+	obj, err := object.GetObject(s, hash)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch o := obj.(type) {
+		case *object.Commit:
+			return o, nil
+		case *object.Tag:
+			if obj, err = o.Object(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, object.ErrUnsupportedObject
+		}
+	}
+}
+
+// objectWalker collects the objects reachable from the roots it is given.
+type objectWalker struct {
+	storer storer.EncodedObjectStorer
+	// cut are the commits whose parents aren't followed.
+	cut map[plumbing.Hash]bool
+	// skip are the objects the client has already.
+	skip   map[plumbing.Hash]bool
+	filter objectFilter
+	seen   map[plumbing.Hash]bool
+	list   []plumbing.Hash
+}
+
+func newObjectWalker(s storer.EncodedObjectStorer, cut, skip map[plumbing.Hash]bool, filter objectFilter) *objectWalker {
+	return &objectWalker{storer: s, cut: cut, skip: skip, filter: filter, seen: make(map[plumbing.Hash]bool)}
+}
+
+func (w *objectWalker) add(hash plumbing.Hash) bool {
+	if w.seen[hash] || w.skip[hash] {
+		return false
+	}
+	w.seen[hash] = true
+	w.list = append(w.list, hash)
+	return true
+}
+
+// walk adds root and what it reaches. A root is added even if the filter
+// leaves its kind out, lazy fetches of partial clones want blobs by id.
+func (w *objectWalker) walk(root plumbing.Hash) error {
+	obj, err := w.storer.EncodedObject(plumbing.AnyObject, root)
+	if err != nil {
+		return err
+	}
+	switch obj.Type() {
+	case plumbing.CommitObject:
+		return w.walkCommits(root)
+	case plumbing.TreeObject:
+		return w.walkTree(root)
+	case plumbing.BlobObject:
+		w.add(root)
+	case plumbing.TagObject:
+		if !w.add(root) {
+			return nil
+		}
+		tag, err := object.DecodeTag(w.storer, obj)
+		if err != nil {
+			return err
+		}
+		return w.walk(tag.Target)
+	}
+	return nil
+}
+
+func (w *objectWalker) walkCommits(start plumbing.Hash) error {
+	stack := []plumbing.Hash{start}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !w.add(hash) {
+			continue
+		}
+		commit, err := object.GetCommit(w.storer, hash)
+		if err != nil {
+			return err
+		}
+		if err := w.walkTree(commit.TreeHash); err != nil {
+			return err
+		}
+		if !w.cut[hash] {
+			stack = append(stack, commit.ParentHashes...)
+		}
+	}
+	return nil
+}
+
+func (w *objectWalker) walkTree(hash plumbing.Hash) error {
+	if !w.add(hash) {
+		return nil
+	}
+	tree, err := object.GetTree(w.storer, hash)
+	if err != nil {
+		return err
+	}
+	for _, entry := range tree.Entries {
+		switch entry.Mode {
+		case filemode.Submodule:
+		case filemode.Dir:
+			if err := w.walkTree(entry.Hash); err != nil {
+				return err
+			}
+		default:
+			if w.seen[entry.Hash] || w.skip[entry.Hash] {
+				continue
+			}
+			omit, err := w.omitBlob(entry.Hash)
+			if err != nil {
+				return err
+			}
+			if !omit {
+				w.add(entry.Hash)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *objectWalker) omitBlob(hash plumbing.Hash) (bool, error) {
+	if !w.filter.Set {
+		return false, nil
+	}
+	if w.filter.Limit == 0 {
+		return true, nil
+	}
+	obj, err := w.storer.EncodedObject(plumbing.BlobObject, hash)
+	if err != nil {
+		return false, err
+	}
+	return obj.Size() >= w.filter.Limit, nil
+}
+
+// objectsToUpload lists what the client is missing: the objects the wants
+// reach down to the cut, without those the common commits reach.
+func objectsToUpload(s storer.EncodedObjectStorer, req *uploadRequest, common []plumbing.Hash, shallow *shallowCut) ([]plumbing.Hash, error) {
+	// The client has the history of the common commits down to its own
+	// shallow commits, blobs left out by a filter aside.
+	client := make(map[plumbing.Hash]bool)
+	for _, hash := range req.Shallows {
+		client[hash] = true
+	}
+	known := newObjectWalker(s, client, nil, objectFilter{})
+	for _, hash := range common {
+		if err := known.walk(hash); err != nil {
+			return nil, err
+		}
+	}
+
+	w := newObjectWalker(s, shallow.cut, known.seen, req.Filter)
+	for _, hash := range append(req.Wants, shallow.parents...) {
+		if err := w.walk(hash); err != nil {
+			return nil, err
+		}
+	}
+	return w.list, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+const (
+	importTimeout     = 30 * time.Minute
+	maxImportProgress = 64 << 10
+	// importJobTTL is how long a finished import can still be looked at.
+	importJobTTL = time.Hour
+	// importsDir holds clones in progress. It is hidden, so scans skip it,
+	// and below Root, so finished clones are renamed into place.
+	importsDir = ".imports"
+)
+
+type ImportStatus string
+
+const (
+	ImportRunning   ImportStatus = "running"
+	ImportDone      ImportStatus = "done"
+	ImportFailed    ImportStatus = "failed"
+	ImportCancelled ImportStatus = "cancelled"
+)
+
+// Credentials authenticate against the remote of an import. Username and
+// Password cover HTTP basic auth and tokens, SSHKey is a PEM private key.
+type Credentials struct {
+	Username      string
+	Password      string
+	SSHKey        string
+	SSHPassphrase string
+}
+
+func (c Credentials) AuthMethod(url string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.SSHKey != "":
+		user := endpoint.User
+		if user == "" {
+			user = "git"
+		}
+		return gitssh.NewPublicKeys(user, []byte(c.SSHKey), c.SSHPassphrase)
+	case c.Password != "":
+		user := c.Username
+		if user == "" {
+			// Token authentication ignores the user but it can't be empty.
+			user = "token"
+		}
+		return &githttp.BasicAuth{Username: user, Password: c.Password}, nil
+	}
+	return nil, nil
+}
+
+// ImportOptions describes a repository cloned from /import.
+type ImportOptions struct {
+	Name        string
+	URL         string
+	Bare        bool
+	Mirror      bool
+	Credentials Credentials
+	// SyncInterval keeps a mirror in sync with the remote when set.
+	SyncInterval time.Duration
+}
+
+// ImportJob is a clone running in the background.
+type ImportJob struct {
+	ID       string
+	Options  ImportOptions
+	Started  time.Time
+	Finished time.Time
+
+	mu       sync.Mutex
+	status   ImportStatus
+	err      error
+	progress []byte
+	cancel   context.CancelFunc
+}
+
+// Write collects the sideband progress of the remote.
+func (job *ImportJob) Write(p []byte) (int, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.progress = append(job.progress, p...)
+	if len(job.progress) > maxImportProgress {
+		job.progress = job.progress[len(job.progress)-maxImportProgress:]
+	}
+	return len(p), nil
+}
+
+func (job *ImportJob) Progress() string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return string(job.progress)
+}
+
+func (job *ImportJob) Status() ImportStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.status
+}
+
+func (job *ImportJob) ErrorMessage() string {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.err == nil {
+		return ""
+	}
+	return job.err.Error()
+}
+
+func (job *ImportJob) Running() bool {
+	return job.Status() == ImportRunning
+}
+
+func (job *ImportJob) Cancel() {
+	job.cancel()
+}
+
+func (job *ImportJob) finish(err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Finished = time.Now()
+	job.err = err
+	switch {
+	case err == nil:
+		job.status = ImportDone
+	case errors.Is(err, context.Canceled):
+		job.status = ImportCancelled
+	default:
+		job.status = ImportFailed
+	}
+}
+
+type ImportJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*ImportJob
+}
+
+func NewImportJobs() *ImportJobs {
+	return &ImportJobs{jobs: make(map[string]*ImportJob)}
+}
+
+func (ij *ImportJobs) Get(id string) (*ImportJob, bool) {
+	ij.mu.Lock()
+	defer ij.mu.Unlock()
+	job, ok := ij.jobs[id]
+	return job, ok
+}
+
+// add registers job unless another import into the same name is running.
+// Jobs finished long ago are dropped.
+func (ij *ImportJobs) add(job *ImportJob) error {
+	ij.mu.Lock()
+	defer ij.mu.Unlock()
+	for id, other := range ij.jobs {
+		if other.Options.Name == job.Options.Name && other.Running() {
+			return fmt.Errorf("%w: %s is being imported", ErrRepositoryExists, job.Options.Name)
+		}
+		if other.finishedBefore(time.Now().Add(-importJobTTL)) {
+			delete(ij.jobs, id)
+		}
+	}
+	ij.jobs[job.ID] = job
+	return nil
+}
+
+func (job *ImportJob) finishedBefore(t time.Time) bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.status != ImportRunning && job.Finished.Before(t)
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// StartImport validates opts and clones the repository in the background.
+// The clone only shows up below Root once it is complete, partially cloned
+// directories are removed when the clone fails.
+func (sc *Smithy) StartImport(opts ImportOptions) (*ImportJob, error) {
+	if err := ValidateRepoName(opts.Name); err != nil {
+		return nil, err
+	}
+	if err := sc.checkNesting(opts.Name); err != nil {
+		return nil, err
+	}
+	if opts.URL == "" {
+		return nil, errors.New("git URL is empty")
+	}
+	if _, exists := sc.FindRepo(opts.Name); exists {
+		return nil, fmt.Errorf("%w: %s", ErrRepositoryExists, opts.Name)
+	}
+	repoPath := filepath.Join(sc.Root, filepath.FromSlash(opts.Name))
+	if _, err := os.Stat(repoPath); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRepositoryExists, opts.Name)
+	}
+	if opts.SyncInterval > 0 && opts.SyncInterval < minMirrorInterval {
+		return nil, fmt.Errorf("mirror interval must be at least %s", minMirrorInterval)
+	}
+	auth, err := opts.Credentials.AuthMethod(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), importTimeout)
+	job := &ImportJob{
+		ID:      newJobID(),
+		Options: opts,
+		Started: time.Now(),
+		status:  ImportRunning,
+		cancel:  cancel,
+	}
+	// The job is listed on /import, the credentials stay out of it. Synced
+	// mirrors keep them in the repository instead.
+	job.Options.Credentials = Credentials{}
+	if err := sc.imports.add(job); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		defer cancel()
+		rwn, err := sc.runImport(ctx, repoPath, opts, auth, job)
+		if err != nil {
+			job.finish(err)
+			return
+		}
+		sc.AddRepository(rwn)
+		job.finish(nil)
+	}()
+	return job, nil
+}
+
+// runImport clones into the imports directory and moves the finished
+// repository to repoPath.
+func (sc *Smithy) runImport(ctx context.Context, repoPath string, opts ImportOptions, auth transport.AuthMethod, job *ImportJob) (RepositoryWithName, error) {
+	var rwn RepositoryWithName
+	tmpPath := filepath.Join(sc.Root, importsDir, job.ID)
+	defer os.RemoveAll(tmpPath)
+	repo, err := cloneRepository(ctx, tmpPath, opts, auth, job)
+	if err != nil {
+		return rwn, err
+	}
+	if opts.Mirror && opts.SyncInterval > 0 {
+		tmp := RepositoryWithName{Name: opts.Name, Repository: repo, Path: tmpPath}
+		err = tmp.setMirror(Mirror{
+			URL:         opts.URL,
+			Interval:    opts.SyncInterval,
+			LastAttempt: job.Started,
+			LastSuccess: job.Started,
+		})
+		if err != nil {
+			return rwn, err
+		}
+		if err := tmp.setMirrorCredentials(opts.Credentials); err != nil {
+			return rwn, err
+		}
+	}
+	if _, err := os.Stat(repoPath); err == nil {
+		return rwn, fmt.Errorf("%w: %s", ErrRepositoryExists, opts.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(repoPath), 0755); err != nil {
+		return rwn, err
+	}
+	if err := os.Rename(tmpPath, repoPath); err != nil {
+		return rwn, err
+	}
+	if repo, err = git.PlainOpen(repoPath); err != nil {
+		return rwn, err
+	}
+	return RepositoryWithName{Name: opts.Name, Repository: repo, Path: repoPath}, nil
+}
+
+func cloneRepository(ctx context.Context, repoPath string, opts ImportOptions, auth transport.AuthMethod, job *ImportJob) (*git.Repository, error) {
+	if !opts.Mirror {
+		return git.PlainCloneContext(ctx, repoPath, opts.Bare, &git.CloneOptions{
+			URL:      opts.URL,
+			Auth:     auth,
+			Progress: job,
+		})
+	}
+
+	// A mirror copies every ref of the remote as is, like git clone --mirror.
+	repo, err := git.PlainInit(repoPath, true)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{
+		Name:  git.DefaultRemoteName,
+		URLs:  []string{opts.URL},
+		Fetch: []config.RefSpec{mirrorRefSpec},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repo, fetchMirror(ctx, repo, remote, auth, job)
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	lfsMediaType = "application/vnd.git-lfs+json"
+	lfsPointerV1 = "version https://git-lfs.github.com/spec/v1"
+	// lfsPointerMaxSize is the size git-lfs itself gives up on parsing a
+	// blob as a pointer.
+	lfsPointerMaxSize = 1024
+	// lfsPreviewMaxSize caps the LFS objects shown inline in the tree view.
+	lfsPreviewMaxSize = 1 << 20
+	lfsLocksPageSize  = 100
+)
+
+var lfsOIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// LFSPointer is the small file git keeps in place of a large one.
+type LFSPointer struct {
+	OID  string
+	Size int64
+}
+
+// ParseLFSPointer reads a pointer file, ok is false for any other content.
+func ParseLFSPointer(contents string) (LFSPointer, bool) {
+	var p LFSPointer
+	if len(contents) > lfsPointerMaxSize || !strings.HasPrefix(contents, lfsPointerV1+"\n") {
+		return p, false
+	}
+	size := ""
+	for _, line := range strings.Split(contents, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "oid":
+			p.OID, _ = strings.CutPrefix(value, "sha256:")
+		case "size":
+			size = value
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 || !lfsOIDPattern.MatchString(p.OID) {
+		return p, false
+	}
+	p.Size = n
+	return p, true
+}
+
+// The LFS objects of a repository are kept the way git-lfs keeps them
+// locally, lfs/objects/ab/cd/abcd... in the git dir.
+func (rwn RepositoryWithName) lfsDir() string {
+	return filepath.Join(rwn.GitDir(), "lfs")
+}
+
+func (rwn RepositoryWithName) lfsObjectPath(oid string) string {
+	return filepath.Join(rwn.lfsDir(), "objects", oid[0:2], oid[2:4], oid)
+}
+
+// LFSObjectSize reports the size of a stored object.
+func (rwn RepositoryWithName) LFSObjectSize(oid string) (int64, bool) {
+	fi, err := os.Stat(rwn.lfsObjectPath(oid))
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+func (rwn RepositoryWithName) OpenLFSObject(oid string) (*os.File, error) {
+	return os.Open(rwn.lfsObjectPath(oid))
+}
+
+// StoreLFSObject writes the object from r, which must hash to oid.
+func (rwn RepositoryWithName) StoreLFSObject(oid string, r io.Reader) (int64, error) {
+	dst := rwn.lfsObjectPath(oid)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(filepath.Join(rwn.lfsDir(), "objects"), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != oid {
+		return 0, fmt.Errorf("content hashes to %s, not %s", sum, oid)
+	}
+	return size, os.Rename(f.Name(), dst)
+}
+
+// linkLFSObjects gives a fork the LFS objects of its parent. Hard links
+// share the storage and survive the deletion of the parent.
+func linkLFSObjects(fork, parent RepositoryWithName) error {
+	root := filepath.Join(parent.lfsDir(), "objects")
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		dst := fork.lfsObjectPath(d.Name())
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if os.Link(path, dst) == nil {
+			return nil
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = fork.StoreLFSObject(d.Name(), src)
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+type LFSLock struct {
+	ID       string       `json:"id"`
+	Path     string       `json:"path"`
+	LockedAt time.Time    `json:"locked_at"`
+	Owner    LFSLockOwner `json:"owner"`
+	Ref      string       `json:"ref,omitempty"`
+}
+
+type LFSLockOwner struct {
+	Name string `json:"name"`
+}
+
+var (
+	errLockExists   = errors.New("already locked")
+	errLockNotFound = errors.New("lock not found")
+	errLockOwner    = errors.New("locked by someone else")
+)
+
+// lfsLocksMu serializes changes to the locks files of all repositories.
+var lfsLocksMu sync.Mutex
+
+func (rwn RepositoryWithName) lfsLocksFile() string {
+	return filepath.Join(rwn.lfsDir(), "locks.json")
+}
+
+func (rwn RepositoryWithName) LFSLocks() ([]LFSLock, error) {
+	b, err := os.ReadFile(rwn.lfsLocksFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var locks []LFSLock
+	return locks, json.Unmarshal(b, &locks)
+}
+
+func (rwn RepositoryWithName) writeLFSLocks(locks []LFSLock) error {
+	b, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(rwn.lfsDir(), 0755); err != nil {
+		return err
+	}
+	tmp := rwn.lfsLocksFile() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rwn.lfsLocksFile())
+}
+
+func (rwn RepositoryWithName) CreateLFSLock(path, ref, owner string) (LFSLock, error) {
+	lfsLocksMu.Lock()
+	defer lfsLocksMu.Unlock()
+	locks, err := rwn.LFSLocks()
+	if err != nil {
+		return LFSLock{}, err
+	}
+	for _, lock := range locks {
+		if lock.Path == path {
+			return lock, errLockExists
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return LFSLock{}, err
+	}
+	lock := LFSLock{
+		ID:       hex.EncodeToString(id),
+		Path:     path,
+		LockedAt: time.Now().UTC().Truncate(time.Second),
+		Owner:    LFSLockOwner{Name: owner},
+		Ref:      ref,
+	}
+	return lock, rwn.writeLFSLocks(append(locks, lock))
+}
+
+// DeleteLFSLock removes a lock held by owner, or any lock with force, which
+// is for admins.
+func (rwn RepositoryWithName) DeleteLFSLock(id, owner string, force bool) (LFSLock, error) {
+	lfsLocksMu.Lock()
+	defer lfsLocksMu.Unlock()
+	locks, err := rwn.LFSLocks()
+	if err != nil {
+		return LFSLock{}, err
+	}
+	for i, lock := range locks {
+		if lock.ID != id {
+			continue
+		}
+		if lock.Owner.Name != owner && !force {
+			return lock, errLockOwner
+		}
+		return lock, rwn.writeLFSLocks(append(locks[:i], locks[i+1:]...))
+	}
+	return LFSLock{}, errLockNotFound
+}
+
+// lfsOwner names who is asking. Smithy has no accounts, so the user name
+// of basic auth is taken at its word.
+func lfsOwner(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return "anonymous"
+}
+
+func writeLFS(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeLFSError(w http.ResponseWriter, code int, err error) {
+	writeLFS(w, code, map[string]string{"message": err.Error()})
+}
+
+// lfsRepo finds the repository of an LFS request and checks that writes
+// are allowed the same way pushes are.
+func (sc *Smithy) lfsRepo(w http.ResponseWriter, r *http.Request, write bool) (RepositoryWithName, bool) {
+	repo, exists := sc.FindRepo(sc.GetParam(r, "repo"))
+	if !exists {
+		writeLFSError(w, http.StatusNotFound, errors.New("Repository not found"))
+		return repo, false
+	}
+	if write {
+		if err := sc.checkPush(repo); err != nil {
+			writeLFSError(w, http.StatusForbidden, err)
+			return repo, false
+		}
+	}
+	return repo, true
+}
+
+func (sc *Smithy) lfsObjectURL(repo RepositoryWithName, oid string) string {
+	return sc.Config().Site.BaseURL + "/" + repo.Name + "/info/lfs/objects/" + oid
+}
+
+type lfsBatchObject struct {
+	OID     string                    `json:"oid"`
+	Size    int64                     `json:"size"`
+	Actions map[string]lfsBatchAction `json:"actions,omitempty"`
+	Error   *lfsObjectError           `json:"error,omitempty"`
+}
+
+type lfsBatchAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// LFSBatch answers where to upload or download each object. Only the
+// basic transfer adapter is supported.
+func (sc *Smithy) LFSBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeLFSError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	var req struct {
+		Operation string           `json:"operation"`
+		Transfers []string         `json:"transfers"`
+		Objects   []lfsBatchObject `json:"objects"`
+		HashAlgo  string           `json:"hash_algo"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 10<<20)).Decode(&req); err != nil {
+		writeLFSError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Operation != "download" && req.Operation != "upload" {
+		writeLFSError(w, http.StatusUnprocessableEntity, fmt.Errorf("unknown operation %q", req.Operation))
+		return
+	}
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		writeLFSError(w, http.StatusConflict, fmt.Errorf("unsupported hash algorithm %q", req.HashAlgo))
+		return
+	}
+	if len(req.Transfers) > 0 && !contains(req.Transfers, "basic") {
+		writeLFSError(w, http.StatusUnprocessableEntity, errors.New("only the basic transfer is supported"))
+		return
+	}
+	repo, ok := sc.lfsRepo(w, r, req.Operation == "upload")
+	if !ok {
+		return
+	}
+
+	objects := make([]lfsBatchObject, 0, len(req.Objects))
+	for _, obj := range req.Objects {
+		out := lfsBatchObject{OID: obj.OID, Size: obj.Size}
+		size, stored := int64(0), false
+		if lfsOIDPattern.MatchString(obj.OID) {
+			size, stored = repo.LFSObjectSize(obj.OID)
+		}
+		href := sc.lfsObjectURL(repo, obj.OID)
+		switch {
+		case !lfsOIDPattern.MatchString(obj.OID) || obj.Size < 0:
+			out.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: "invalid object"}
+		case req.Operation == "download" && !stored:
+			out.Error = &lfsObjectError{Code: http.StatusNotFound, Message: "object does not exist"}
+		case req.Operation == "download":
+			out.Size = size
+			out.Actions = map[string]lfsBatchAction{"download": {Href: href}}
+		case stored && size == obj.Size:
+			// Already uploaded, no actions.
+		default:
+			out.Actions = map[string]lfsBatchAction{
+				"upload": {Href: href},
+				"verify": {Href: sc.Config().Site.BaseURL + "/" + repo.Name + "/info/lfs/objects/verify"},
+			}
+		}
+		objects = append(objects, out)
+	}
+	writeLFS(w, http.StatusOK, map[string]any{
+		"transfer":  "basic",
+		"objects":   objects,
+		"hash_algo": "sha256",
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// LFSObject downloads an object with GET and uploads one with PUT. Uploads
+// are checked against their oid before they are stored.
+func (sc *Smithy) LFSObject(w http.ResponseWriter, r *http.Request) {
+	oid := sc.GetParam(r, "oid")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		repo, ok := sc.lfsRepo(w, r, false)
+		if !ok {
+			return
+		}
+		f, err := repo.OpenLFSObject(oid)
+		if err != nil {
+			writeLFSError(w, http.StatusNotFound, errors.New("object does not exist"))
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			writeLFSError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"`+oid+`"`)
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	case http.MethodPut:
+		repo, ok := sc.lfsRepo(w, r, true)
+		if !ok {
+			return
+		}
+		if r.ContentLength >= 0 {
+			if size, stored := repo.LFSObjectSize(oid); stored && size == r.ContentLength {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+		if _, err := repo.StoreLFSObject(oid, r.Body); err != nil {
+			log.Printf("lfs: storing %s in %s: %v", oid, repo.Name, err)
+			writeLFSError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeLFSError(w, http.StatusMethodNotAllowed, errors.New("use GET or PUT"))
+	}
+}
+
+// LFSVerify confirms an upload arrived whole.
+func (sc *Smithy) LFSVerify(w http.ResponseWriter, r *http.Request) {
+	repo, ok := sc.lfsRepo(w, r, true)
+	if !ok {
+		return
+	}
+	var obj lfsBatchObject
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&obj); err != nil {
+		writeLFSError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !lfsOIDPattern.MatchString(obj.OID) {
+		writeLFSError(w, http.StatusUnprocessableEntity, errors.New("invalid object"))
+		return
+	}
+	size, stored := repo.LFSObjectSize(obj.OID)
+	if !stored {
+		writeLFSError(w, http.StatusNotFound, errors.New("object does not exist"))
+		return
+	}
+	if size != obj.Size {
+		writeLFSError(w, http.StatusUnprocessableEntity, fmt.Errorf("object is %d bytes, not %d", size, obj.Size))
+		return
+	}
+	writeLFS(w, http.StatusOK, map[string]string{})
+}
+
+// pageLocks returns the locks from cursor on and the cursor of the next
+// page, empty on the last one.
+func pageLocks(locks []LFSLock, cursor string, limit int) ([]LFSLock, string) {
+	if limit <= 0 || limit > lfsLocksPageSize {
+		limit = lfsLocksPageSize
+	}
+	start, _ := strconv.Atoi(cursor)
+	if start < 0 || start > len(locks) {
+		start = len(locks)
+	}
+	end := start + limit
+	if end >= len(locks) {
+		return locks[start:], ""
+	}
+	return locks[start:end], strconv.Itoa(end)
+}
+
+// LFSLocks lists the locks with GET, filtered by path, id or ref, and
+// creates one with POST.
+func (sc *Smithy) LFSLocks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		repo, ok := sc.lfsRepo(w, r, false)
+		if !ok {
+			return
+		}
+		all, err := repo.LFSLocks()
+		if err != nil {
+			writeLFSError(w, http.StatusInternalServerError, err)
+			return
+		}
+		q := r.URL.Query()
+		locks := []LFSLock{}
+		for _, lock := range all {
+			if p := q.Get("path"); p != "" && lock.Path != p {
+				continue
+			}
+			if id := q.Get("id"); id != "" && lock.ID != id {
+				continue
+			}
+			if ref := q.Get("refspec"); ref != "" && lock.Ref != "" && lock.Ref != ref {
+				continue
+			}
+			locks = append(locks, lock)
+		}
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		page, next := pageLocks(locks, q.Get("cursor"), limit)
+		writeLFS(w, http.StatusOK, map[string]any{"locks": page, "next_cursor": next})
+	case http.MethodPost:
+		repo, ok := sc.lfsRepo(w, r, true)
+		if !ok {
+			return
+		}
+		var req struct {
+			Path string `json:"path"`
+			Ref  struct {
+				Name string `json:"name"`
+			} `json:"ref"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || req.Path == "" {
+			writeLFSError(w, http.StatusBadRequest, errors.New("a lock needs a path"))
+			return
+		}
+		lock, err := repo.CreateLFSLock(req.Path, req.Ref.Name, lfsOwner(r))
+		if errors.Is(err, errLockExists) {
+			writeLFS(w, http.StatusConflict, map[string]any{"lock": lock, "message": "already locked"})
+			return
+		}
+		if err != nil {
+			writeLFSError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeLFS(w, http.StatusCreated, map[string]any{"lock": lock})
+	default:
+		writeLFSError(w, http.StatusMethodNotAllowed, errors.New("use GET or POST"))
+	}
+}
+
+// LFSLocksVerify splits the locks into those of the caller and the rest,
+// git lfs asks before pushing.
+func (sc *Smithy) LFSLocksVerify(w http.ResponseWriter, r *http.Request) {
+	repo, ok := sc.lfsRepo(w, r, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Cursor string `json:"cursor"`
+		Limit  int    `json:"limit"`
+		Ref    struct {
+			Name string `json:"name"`
+		} `json:"ref"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil && err != io.EOF {
+		writeLFSError(w, http.StatusBadRequest, err)
+		return
+	}
+	all, err := repo.LFSLocks()
+	if err != nil {
+		writeLFSError(w, http.StatusInternalServerError, err)
+		return
+	}
+	page, next := pageLocks(all, req.Cursor, req.Limit)
+	owner := lfsOwner(r)
+	ours, theirs := []LFSLock{}, []LFSLock{}
+	for _, lock := range page {
+		if lock.Owner.Name == owner {
+			ours = append(ours, lock)
+		} else {
+			theirs = append(theirs, lock)
+		}
+	}
+	writeLFS(w, http.StatusOK, map[string]any{"ours": ours, "theirs": theirs, "next_cursor": next})
+}
+
+func (sc *Smithy) LFSUnlock(w http.ResponseWriter, r *http.Request) {
+	repo, ok := sc.lfsRepo(w, r, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Force bool `json:"force"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil && err != io.EOF {
+		writeLFSError(w, http.StatusBadRequest, err)
+		return
+	}
+	// Owners are whatever the clients claim, only admins may break locks.
+	if req.Force && !sc.checkAdmin(r) {
+		writeLFSError(w, http.StatusForbidden, errors.New("force unlock needs the admin token"))
+		return
+	}
+	lock, err := repo.DeleteLFSLock(sc.GetParam(r, "id"), lfsOwner(r), req.Force)
+	switch {
+	case errors.Is(err, errLockNotFound):
+		writeLFSError(w, http.StatusNotFound, err)
+	case errors.Is(err, errLockOwner):
+		writeLFSError(w, http.StatusForbidden, err)
+	case err != nil:
+		writeLFSError(w, http.StatusInternalServerError, err)
+	default:
+		writeLFS(w, http.StatusOK, map[string]any{"lock": lock})
+	}
+}
+
+// LFSFile is what the tree view shows for a pointer file.
+type LFSFile struct {
+	LFSPointer
+	Stored bool
+	// Contents is set for stored objects small enough to show that are
+	// text.
+	Contents string
+}
+
+func (rwn RepositoryWithName) lfsFile(p LFSPointer) *LFSFile {
+	f := &LFSFile{LFSPointer: p}
+	size, stored := rwn.LFSObjectSize(p.OID)
+	f.Stored = stored && size == p.Size
+	if !f.Stored || size > lfsPreviewMaxSize {
+		return f
+	}
+	obj, err := rwn.OpenLFSObject(p.OID)
+	if err != nil {
+		return f
+	}
+	defer obj.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(bufio.NewReader(obj)); err == nil && utf8.Valid(buf.Bytes()) &&
+		!bytes.ContainsRune(buf.Bytes(), 0) {
+		f.Contents = buf.String()
+	}
+	return f
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestForceUnlockNeedsAdmin(t *testing.T) {
+	sc, url := newProtocolServer(t, GitBackendExec)
+	cfg := *sc.Config()
+	cfg.AdminToken = "secret"
+	sc.SetConfig(&cfg)
+	rwn, _ := sc.FindRepo("repo.git")
+	lock, err := rwn.CreateLFSLock("big.bin", "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := func(user, password string) int {
+		req, err := http.NewRequest(http.MethodPost, url+"/info/lfs/locks/"+lock.ID+"/unlock", strings.NewReader(`{"force":true}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(user, password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := unlock("bob", ""); code != http.StatusForbidden {
+		t.Fatalf("force unlock without the token: %d, want 403", code)
+	}
+	if locks, _ := rwn.LFSLocks(); len(locks) != 1 {
+		t.Fatalf("lock removed: %v", locks)
+	}
+	if code := unlock("bob", "secret"); code != http.StatusOK {
+		t.Fatalf("force unlock by an admin: %d", code)
+	}
+	if locks, _ := rwn.LFSLocks(); len(locks) != 0 {
+		t.Fatalf("lock left: %v", locks)
+	}
+}
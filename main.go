@@ -2,42 +2,196 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"path"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	var port string
-	home, _ := os.UserHomeDir()
-	root := path.Join(home, "Projects")
-	flag.StringVar(&root, "root", root, "repos root dir")
-	flag.StringVar(&port, "port", "3456", "listen port")
+	defaults := DefaultConfig()
+	configFile := flag.String("config", os.Getenv("SMITHY_CONFIG"), "JSON config file, reloaded on SIGHUP")
+	root := flag.String("root", defaults.Root, "repos root dir")
+	port := flag.String("port", "", "listen port, shorthand for -listen :port")
+	listen := flag.String("listen", strings.Join(defaults.Listen, ","), "comma separated listen addresses")
+	keyring := flag.String("keyring", "", "dir of OpenPGP keys (*.asc) and ssh allowed_signers files")
+	index := flag.String("index", defaults.Index, "search index dir")
+	rescan := flag.Duration("rescan", time.Duration(defaults.Rescan), "interval of full rescans of the root dir")
+	templates := flag.String("templates", "", "dir of templates replacing the embedded ones by name")
+	static := flag.String("static", "", "dir of static files replacing the embedded ones by name")
+	dev := flag.Bool("dev", false, "reload templates and static files on every request")
+	gitBackend := flag.String("git-backend", defaults.GitBackend, "git to run the git binary, go to serve smart HTTP with go-git")
+	adminToken := flag.String("admin-token", "", "bearer token for admin endpoints like POST /reload")
 	flag.Parse()
 
-	sc := NewSmithy(root)
-	sc.LoadTemplates()
+	// Flags given on the command line win over the environment, which wins
+	// over the config file.
+	loadConfig := func() (*Config, error) {
+		cfg, err := ReadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.ApplyEnv(); err != nil {
+			return nil, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "root":
+				cfg.Root = *root
+			case "port":
+				cfg.Listen = []string{":" + *port}
+			case "listen":
+				cfg.Listen = strings.Split(*listen, ",")
+			case "keyring":
+				cfg.Keyring = *keyring
+			case "index":
+				cfg.Index = *index
+			case "rescan":
+				cfg.Rescan = Duration(*rescan)
+			case "templates":
+				cfg.Templates = *templates
+			case "static":
+				cfg.Static = *static
+			case "dev":
+				cfg.Dev = *dev
+			case "git-backend":
+				cfg.GitBackend = *gitBackend
+			case "admin-token":
+				cfg.AdminToken = *adminToken
+			}
+		})
+		return cfg, cfg.Validate()
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+
+	sc := NewSmithy(cfg.Root)
+	sc.SetConfig(cfg)
+	sc.Search = NewSearchIndex(cfg.Index)
+	if flag.Arg(0) == "shell" {
+		if err := sc.RunShell(); err != nil {
+			fmt.Fprintf(os.Stderr, "smithy: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.Keyring != "" {
+		k, err := LoadKeyring(cfg.Keyring)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sc.Keyring = k
+	}
+	if err := sc.LoadTheme(); err != nil {
+		log.Fatalf("theme: %v", err)
+	}
 	sc.LoadAllRepositories()
+	sc.Repositories().Subscribe(sc.onRepositoryChange)
+	go sc.Search.UpdateAll(sc.GetRepositories())
+	go sc.RunMirrors()
+	go sc.Watch(time.Duration(cfg.Rescan))
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			next, err := loadConfig()
+			if err != nil {
+				log.Printf("config: %v, keeping the current config", err)
+				continue
+			}
+			current := sc.Config()
+			if fields := restartOnly(current, next); len(fields) > 0 {
+				log.Printf("config: changing %s needs a restart, keeping the running values", strings.Join(fields, ", "))
+			}
+			next.Listen, next.Root, next.Index = current.Listen, current.Root, current.Index
+			next.Keyring, next.Rescan = current.Keyring, current.Rescan
+			sc.SetConfig(next)
+			if err := sc.LoadTheme(); err != nil {
+				log.Printf("theme: %v, keeping the last good theme", err)
+			}
+			log.Printf("config: reloaded")
+		}
+	}()
 
+	router := sc.Handler()
+	errs := make(chan error)
+	for _, addr := range cfg.Listen {
+		go func(addr string) {
+			errs <- http.ListenAndServe(addr, router)
+		}(addr)
+	}
+	log.Fatal(<-errs)
+}
+
+// Handler routes the requests of the site, the repositories and the git
+// protocols.
+func (sc *Smithy) Handler() http.Handler {
 	routes := []Route{
 		{pattern: r(`^/$`), handler: sc.IndexView},
 		{pattern: r(`^/new$`), handler: sc.NewProject},
 		{pattern: r(`^/import$`), handler: sc.ImportProject},
+		{pattern: r(`^/import/(?P<job>[0-9a-f]+)$`), handler: sc.ImportStatusView},
+		{pattern: r(`^/import/(?P<job>[0-9a-f]+)/progress$`), handler: sc.ImportProgressView},
+		{pattern: r(`^/import/(?P<job>[0-9a-f]+)/cancel$`), handler: sc.ImportCancel},
 		{pattern: r(`^/reload$`), handler: sc.Reload},
-		{pattern: r(`^/(?P<repo>[^/]+)$`), handler: sc.RepoView},
-		{pattern: r(`^/(?P<repo>[^/]+)/refs$`), handler: sc.RefsView},
-		{pattern: r(`^/(?P<repo>[^/]+)/log$`), handler: sc.LogView},
-		{pattern: r(`^/(?P<repo>[^/]+)/log/(?P<ref>[^/]+)?$`), handler: sc.LogView},
-		{pattern: r(`^/(?P<repo>[^/]+)/patch/(?P<hash>[^/]+)$`), handler: sc.PatchView},
-		{pattern: r(`^/(?P<repo>[^/]+)/commit/(?P<hash>[^/]+)`), handler: sc.CommitView},
-		{pattern: r(`^/(?P<repo>[^/]+)/tree$`), handler: sc.TreeView},
-		{pattern: r(`^/(?P<repo>[^/]+)/tree/(?P<ref>[^/]+)$`), handler: sc.TreeView},
-		{pattern: r(`^/(?P<repo>[^/]+)/tree/(?P<ref>[^/]+)?/(?P<path>.*)`), handler: sc.TreeView},
-		{pattern: r(`^/(?P<repo>[^/]+)/info/refs$`), handler: sc.getInfoRefs},
-		{pattern: r(`^/(?P<repo>[^/]+)/git-upload-pack$`), handler: sc.uploadPack},
-		{pattern: r(`^/(?P<repo>[^/]+)/git-receive-pack$`), handler: sc.receivePack},
-	}
-
-	router := NewRouter(routes)
-	http.ListenAndServe(":"+port, router)
+		{pattern: r(`^/search$`), handler: sc.SearchView},
+		{pattern: r(`^/feed\.atom$`), handler: sc.SiteFeed},
+		{pattern: r(`^/static/(?P<path>.+)$`), handler: sc.StaticView},
+		Mount("repo", sc.MatchRepo, sc.repoRoutes([]Route{
+			{pattern: r(`^/?$`), handler: sc.RepoView},
+			{pattern: r(`^/refs$`), handler: sc.RefsView},
+			{pattern: r(`^/settings$`), handler: sc.SettingsView},
+			{pattern: r(`^/releases$`), handler: sc.ReleasesView},
+			{pattern: r(`^/releases/latest$`), handler: sc.ReleaseLatest},
+			{pattern: r(`^/releases/tag/(?P<tag>.+)$`), handler: sc.ReleaseView},
+			{pattern: r(`^/releases/download/(?P<tag>.+)/(?P<asset>[^/]+)$`), handler: sc.ReleaseDownload},
+			{pattern: r(`^/releases/archive/(?P<tag>.+)\.(?P<format>tar\.gz|zip)$`), handler: sc.ReleaseArchive},
+			{pattern: r(`^/api/releases$`), handler: sc.ReleasesAPI},
+			{pattern: r(`^/api/releases/(?P<tag>.+)/assets/(?P<asset>[^/]+)$`), handler: sc.ReleaseAssetAPI},
+			{pattern: r(`^/api/releases/(?P<tag>.+)$`), handler: sc.ReleaseAPI},
+			{pattern: r(`^/fork$`), handler: sc.ForkView},
+			{pattern: r(`^/compare/?$`), handler: sc.CompareView},
+			{pattern: r(`^/compare/(?P<spec>.+)$`), handler: sc.CompareView},
+			{pattern: r(`^/log\.atom$`), handler: sc.LogFeed},
+			{pattern: r(`^/log/(?P<ref>.+)\.atom$`), handler: sc.LogFeed},
+			{pattern: r(`^/tags\.atom$`), handler: sc.TagsFeed},
+			{pattern: r(`^/log$`), handler: sc.LogView},
+			{pattern: r(`^/search$`), handler: sc.CommitSearchView},
+			{pattern: r(`^/log/(?P<ref>.+)?$`), handler: sc.LogView},
+			{pattern: r(`^/patch/(?P<hash>.+)$`), handler: sc.PatchView},
+			{pattern: r(`^/commit/(?P<hash>.+)$`), handler: sc.CommitView},
+			{pattern: r(`^/tree/?$`), handler: sc.TreeView},
+			{pattern: r(`^/tree/(?P<rest>.+)$`), handler: sc.TreeView},
+			{pattern: r(`^/info/refs$`), handler: sc.getInfoRefs},
+			{pattern: r(`^/info/lfs/objects/batch$`), handler: sc.LFSBatch},
+			{pattern: r(`^/info/lfs/objects/verify$`), handler: sc.LFSVerify},
+			{pattern: r(`^/info/lfs/objects/(?P<oid>[0-9a-f]{64})$`), handler: sc.LFSObject},
+			{pattern: r(`^/info/lfs/locks$`), handler: sc.LFSLocks},
+			{pattern: r(`^/info/lfs/locks/verify$`), handler: sc.LFSLocksVerify},
+			{pattern: r(`^/info/lfs/locks/(?P<id>[^/]+)/unlock$`), handler: sc.LFSUnlock},
+			{pattern: r(`^/git-upload-pack$`), handler: sc.uploadPack},
+			{pattern: r(`^/git-receive-pack$`), handler: sc.receivePack},
+			{pattern: r(`^/HEAD$`), handler: sc.DumbHead},
+			{pattern: r(`^/objects/info/packs$`), handler: sc.DumbInfoPacks},
+			{pattern: r(`^/objects/(?P<dir>[0-9a-f]{2})/(?P<file>[0-9a-f]{38})$`), handler: sc.DumbLooseObject},
+			{pattern: r(`^/objects/pack/(?P<pack>pack-[0-9a-f]{40}\.(pack|idx))$`), handler: sc.DumbPackFile},
+		})),
+		{pattern: r(`^/(?P<group>.+?)/?$`), handler: sc.IndexView},
+	}
+	return NewRouter(routes)
+}
+
+// repoRoutes puts the routes of a repository behind repoAccess.
+func (sc *Smithy) repoRoutes(routes []Route) []Route {
+	for i := range routes {
+		routes[i].handler = sc.repoAccess(routes[i].handler)
+	}
+	return routes
 }
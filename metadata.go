@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// defaultDescription is what git init writes to the description file.
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository."
+
+// GitDir is the directory holding the repository's objects and config.
+func (rwn RepositoryWithName) GitDir() string {
+	dotGit := filepath.Join(rwn.Path, ".git")
+	if fi, err := os.Stat(dotGit); err == nil && fi.IsDir() {
+		return dotGit
+	}
+	return rwn.Path
+}
+
+func (rwn RepositoryWithName) ReadDescription() string {
+	b, err := os.ReadFile(filepath.Join(rwn.GitDir(), "description"))
+	if err != nil {
+		return ""
+	}
+	description := strings.TrimSpace(string(b))
+	if description == defaultDescription {
+		return ""
+	}
+	return description
+}
+
+func (rwn RepositoryWithName) WriteDescription(description string) error {
+	description = strings.TrimSpace(description)
+	if description == "" {
+		description = defaultDescription
+	}
+	return os.WriteFile(filepath.Join(rwn.GitDir(), "description"), []byte(description+"\n"), 0644)
+}
+
+// ReadOwner reads smithy.owner, falling back to gitweb.owner.
+func (rwn RepositoryWithName) ReadOwner() string {
+	cfg, err := rwn.Repository.Config()
+	if err != nil {
+		return ""
+	}
+	if owner := cfg.Raw.Section("smithy").Option("owner"); owner != "" {
+		return owner
+	}
+	return cfg.Raw.Section("gitweb").Option("owner")
+}
+
+func (rwn RepositoryWithName) configOption(key string) string {
+	cfg, err := rwn.Repository.Config()
+	if err != nil {
+		return ""
+	}
+	return cfg.Raw.Section("smithy").Option(key)
+}
+
+func (rwn RepositoryWithName) setConfigOption(key, value string) error {
+	cfg, err := rwn.Repository.Config()
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		cfg.Raw.Section("smithy").RemoveOption(key)
+	} else {
+		cfg.Raw.Section("smithy").SetOption(key, value)
+	}
+	return rwn.Repository.SetConfig(cfg)
+}
+
+// IsArchived reports whether the repository is read-only.
+func (rwn RepositoryWithName) IsArchived() bool {
+	return rwn.configOption("archived") == "true"
+}
+
+func (rwn RepositoryWithName) SetArchived(archived bool) error {
+	if archived {
+		return rwn.setConfigOption("archived", "true")
+	}
+	return rwn.setConfigOption("archived", "")
+}
+
+// Repository visibilities, see SetVisibility.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// IsPrivate reports whether only admins may browse and fetch the
+// repository over HTTP. SSH access is up to authorized_keys.
+func (rwn RepositoryWithName) IsPrivate() bool {
+	return rwn.configOption("private") == "true"
+}
+
+// IsUnlisted reports whether the repository is hidden from the index, the
+// site feed and search. Unless it is private too, it is still served to
+// anyone knowing its URL.
+func (rwn RepositoryWithName) IsUnlisted() bool {
+	return rwn.configOption("unlisted") == "true" || rwn.IsPrivate()
+}
+
+func (rwn RepositoryWithName) Visibility() string {
+	switch {
+	case rwn.IsPrivate():
+		return VisibilityPrivate
+	case rwn.IsUnlisted():
+		return VisibilityUnlisted
+	}
+	return VisibilityPublic
+}
+
+// SetVisibility makes the repository public, unlisted or private. Private
+// repositories are unlisted as well.
+func (rwn RepositoryWithName) SetVisibility(visibility string) error {
+	var private, unlisted string
+	switch visibility {
+	case VisibilityPublic:
+	case VisibilityUnlisted:
+		unlisted = "true"
+	case VisibilityPrivate:
+		private = "true"
+	default:
+		return fmt.Errorf("unknown visibility %q", visibility)
+	}
+	if err := rwn.setConfigOption("private", private); err != nil {
+		return err
+	}
+	return rwn.setConfigOption("unlisted", unlisted)
+}
+
+// SetDefaultBranch points HEAD at branch.
+func (rwn RepositoryWithName) SetDefaultBranch(branch string) error {
+	name := plumbing.NewBranchReferenceName(branch)
+	if _, err := rwn.Repository.Reference(name, false); err != nil {
+		return fmt.Errorf("branch %s: %w", branch, err)
+	}
+	return rwn.Repository.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, name))
+}
+
+type RepoMetadata struct {
+	Description  string
+	Owner        string
+	LastActivity time.Time
+}
+
+func (m RepoMetadata) LastCommit() string {
+	if m.LastActivity.IsZero() {
+		return ""
+	}
+	return m.LastActivity.Format(time.DateTime)
+}
+
+func (m RepoMetadata) Age() string {
+	return HumanizeAge(m.LastActivity)
+}
+
+// RepositoryInfo is a repository with its metadata, as listed on the index.
+type RepositoryInfo struct {
+	RepositoryWithName
+	RepoMetadata
+}
+
+type activityEntry struct {
+	fingerprint [sha1.Size]byte
+	when        time.Time
+}
+
+// ActivityCache remembers the last activity of each repository. An entry is
+// reused as long as no reference of the repository moved.
+type ActivityCache struct {
+	mu      sync.Mutex
+	entries map[string]activityEntry
+}
+
+func NewActivityCache() *ActivityCache {
+	return &ActivityCache{entries: make(map[string]activityEntry)}
+}
+
+func (ac *ActivityCache) Forget(name string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	delete(ac.entries, name)
+}
+
+// LastActivity is the newest committer or tagger date over all references.
+func (ac *ActivityCache) LastActivity(rwn RepositoryWithName) time.Time {
+	iter, err := rwn.Repository.References()
+	if err != nil {
+		return time.Time{}
+	}
+	var refs []*plumbing.Reference
+	h := sha1.New()
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs = append(refs, ref)
+			io.WriteString(h, ref.Name().String()+" "+ref.Hash().String()+"\n")
+		}
+		return nil
+	})
+	var fingerprint [sha1.Size]byte
+	copy(fingerprint[:], h.Sum(nil))
+
+	ac.mu.Lock()
+	entry, ok := ac.entries[rwn.Name]
+	ac.mu.Unlock()
+	if ok && entry.fingerprint == fingerprint {
+		return entry.when
+	}
+
+	var when time.Time
+	for _, ref := range refs {
+		commit, tag, err := PeelToCommit(rwn.Repository, ref.Hash())
+		if tag != nil && tag.Tagger.When.After(when) {
+			when = tag.Tagger.When
+		}
+		if err == nil && commit.Committer.When.After(when) {
+			when = commit.Committer.When
+		}
+	}
+
+	ac.mu.Lock()
+	ac.entries[rwn.Name] = activityEntry{fingerprint: fingerprint, when: when}
+	ac.mu.Unlock()
+	return when
+}
+
+func (sc *Smithy) Metadata(rwn RepositoryWithName) RepoMetadata {
+	return RepoMetadata{
+		Description:  rwn.ReadDescription(),
+		Owner:        rwn.ReadOwner(),
+		LastActivity: sc.activity.LastActivity(rwn),
+	}
+}
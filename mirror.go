@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	defaultMirrorInterval = time.Hour
+	minMirrorInterval     = time.Minute
+	mirrorCheckInterval   = time.Minute
+)
+
+// mirrorCredentialsFile keeps the credentials of a mirror's upstream in the
+// git dir, readable only by the user running Smithy. No route serves it.
+const mirrorCredentialsFile = "smithy-mirror-credentials.json"
+
+// mirrorRefSpec copies every ref of the upstream as is.
+const mirrorRefSpec = config.RefSpec("+refs/*:refs/*")
+
+// Mirror is the pull mirror configuration and sync status of a repository,
+// kept in the smithy section of its config.
+type Mirror struct {
+	URL         string
+	Interval    time.Duration
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string
+}
+
+func (m Mirror) LastSynced() string {
+	return HumanizeAge(m.LastSuccess)
+}
+
+// Due reports whether the next scheduled sync should run.
+func (m Mirror) Due(now time.Time) bool {
+	return now.Sub(m.LastAttempt) >= m.Interval
+}
+
+func parseConfigTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+func formatConfigTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Mirror returns the pull mirror settings, ok is false for regular
+// repositories.
+func (rwn RepositoryWithName) Mirror() (m Mirror, ok bool) {
+	cfg, err := rwn.Repository.Config()
+	if err != nil {
+		return m, false
+	}
+	section := cfg.Raw.Section("smithy")
+	m.URL = section.Option("mirrorurl")
+	if m.URL == "" {
+		return m, false
+	}
+	m.Interval, err = time.ParseDuration(section.Option("mirrorinterval"))
+	if err != nil || m.Interval < minMirrorInterval {
+		m.Interval = defaultMirrorInterval
+	}
+	m.LastAttempt = parseConfigTime(section.Option("mirrorlastattempt"))
+	m.LastSuccess = parseConfigTime(section.Option("mirrorlastsuccess"))
+	m.LastError = section.Option("mirrorlasterror")
+	return m, true
+}
+
+// IsMirror reports whether the repository is a pull mirror. Mirrors are
+// read-only, their refs are owned by the upstream.
+func (rwn RepositoryWithName) IsMirror() bool {
+	_, ok := rwn.Mirror()
+	return ok
+}
+
+func (rwn RepositoryWithName) setMirror(m Mirror) error {
+	cfg, err := rwn.Repository.Config()
+	if err != nil {
+		return err
+	}
+	section := cfg.Raw.Section("smithy")
+	var interval string
+	if m.URL != "" {
+		interval = m.Interval.String()
+	}
+	options := []struct{ key, value string }{
+		{"mirrorurl", m.URL},
+		{"mirrorinterval", interval},
+		{"mirrorlastattempt", formatConfigTime(m.LastAttempt)},
+		{"mirrorlastsuccess", formatConfigTime(m.LastSuccess)},
+		{"mirrorlasterror", m.LastError},
+	}
+	for _, o := range options {
+		if o.value == "" || m.URL == "" {
+			section.RemoveOption(o.key)
+		} else {
+			section.SetOption(o.key, o.value)
+		}
+	}
+	return rwn.Repository.SetConfig(cfg)
+}
+
+// SetMirror turns the repository into a pull mirror of url, synced every
+// interval. An empty url turns it back into a regular repository.
+func (rwn RepositoryWithName) SetMirror(url string, interval time.Duration) error {
+	if url != "" {
+		if _, err := transport.NewEndpoint(url); err != nil {
+			return err
+		}
+		if interval < minMirrorInterval {
+			return fmt.Errorf("mirror interval must be at least %s", minMirrorInterval)
+		}
+	}
+	m, _ := rwn.Mirror()
+	if m.URL != url {
+		// The status and credentials of the old upstream don't apply
+		// anymore.
+		m = Mirror{}
+		if err := rwn.setMirrorCredentials(Credentials{}); err != nil {
+			return err
+		}
+	}
+	m.URL = url
+	m.Interval = interval
+	return rwn.setMirror(m)
+}
+
+// mirrorCredentials returns the credentials stored for the upstream, none
+// for public ones.
+func (rwn RepositoryWithName) mirrorCredentials() (Credentials, error) {
+	var c Credentials
+	b, err := os.ReadFile(filepath.Join(rwn.GitDir(), mirrorCredentialsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// setMirrorCredentials stores the credentials the scheduled syncs use, empty
+// ones remove the file.
+func (rwn RepositoryWithName) setMirrorCredentials(c Credentials) error {
+	path := filepath.Join(rwn.GitDir(), mirrorCredentialsFile)
+	if c == (Credentials{}) {
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// The file may predate the permissions.
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fetchMirror fetches all refs of remote, prunes the ones deleted upstream
+// and points HEAD where the upstream HEAD points.
+func fetchMirror(ctx context.Context, repo *git.Repository, remote *git.Remote, auth transport.AuthMethod, progress io.Writer) error {
+	err := remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{mirrorRefSpec},
+		Auth:     auth,
+		Progress: progress,
+		Tags:     git.AllTags,
+		Force:    true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return err
+	}
+	upstream := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range refs {
+		upstream[ref.Name()] = true
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			err = repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, ref.Target()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// go-git can't prune on fetch, remove what is gone upstream by hand.
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	var stale []plumbing.ReferenceName
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD && !upstream[ref.Name()] {
+			stale = append(stale, ref.Name())
+		}
+		return nil
+	})
+	for _, name := range stale {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MirrorScheduler syncs pull mirrors when they are due and makes sure a
+// repository is never synced twice at the same time.
+type MirrorScheduler struct {
+	mu      sync.Mutex
+	syncing map[string]bool
+}
+
+func NewMirrorScheduler() *MirrorScheduler {
+	return &MirrorScheduler{syncing: make(map[string]bool)}
+}
+
+func (ms *MirrorScheduler) start(name string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.syncing[name] {
+		return false
+	}
+	ms.syncing[name] = true
+	return true
+}
+
+func (ms *MirrorScheduler) done(name string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.syncing, name)
+}
+
+func (ms *MirrorScheduler) Syncing(name string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.syncing[name]
+}
+
+// SyncMirror fetches the upstream of a pull mirror and records the outcome.
+func (sc *Smithy) SyncMirror(rwn RepositoryWithName) error {
+	m, ok := rwn.Mirror()
+	if !ok {
+		return fmt.Errorf("%s is not a mirror", rwn.Name)
+	}
+	if !sc.mirrors.start(rwn.Name) {
+		return fmt.Errorf("%s is already being synced", rwn.Name)
+	}
+	defer sc.mirrors.done(rwn.Name)
+
+	creds, err := rwn.mirrorCredentials()
+	if err != nil {
+		return err
+	}
+	auth, err := creds.AuthMethod(m.URL)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), importTimeout)
+	defer cancel()
+	remote := git.NewRemote(rwn.Repository.Storer, &config.RemoteConfig{
+		Name:  "mirror",
+		URLs:  []string{m.URL},
+		Fetch: []config.RefSpec{mirrorRefSpec},
+	})
+	m.LastAttempt = time.Now()
+	err = fetchMirror(ctx, rwn.Repository, remote, auth, nil)
+	if err != nil {
+		m.LastError = err.Error()
+	} else {
+		m.LastSuccess = m.LastAttempt
+		m.LastError = ""
+	}
+	if err := rwn.setMirror(m); err != nil {
+		log.Printf("mirror: recording status of %s: %v", rwn.Name, err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := sc.Search.Update(rwn); err != nil {
+		log.Printf("search: indexing %s: %v", rwn.Name, err)
+	}
+	return nil
+}
+
+// MirrorStatus returns the mirror settings of the named repository or nil,
+// for the banner in nav.html.
+func (sc *Smithy) MirrorStatus(name string) *Mirror {
+	rwn, exists := sc.FindRepo(name)
+	if !exists {
+		return nil
+	}
+	if m, ok := rwn.Mirror(); ok {
+		return &m
+	}
+	return nil
+}
+
+// RunMirrors checks every minute for pull mirrors that are due and syncs
+// them in the background.
+func (sc *Smithy) RunMirrors() {
+	ticker := time.NewTicker(mirrorCheckInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, rwn := range sc.GetRepositories() {
+			m, ok := rwn.Mirror()
+			if !ok || !m.Due(now) || sc.mirrors.Syncing(rwn.Name) {
+				continue
+			}
+			if !sc.Config().For(rwn.Name).Features.MirrorsEnabled() {
+				continue
+			}
+			go func(rwn RepositoryWithName) {
+				if err := sc.SyncMirror(rwn); err != nil {
+					log.Printf("mirror: syncing %s: %v", rwn.Name, err)
+				}
+			}(rwn)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func newTestSmithy(t *testing.T) *Smithy {
+	t.Helper()
+	sc := NewSmithy(t.TempDir())
+	sc.Search = NewSearchIndex(t.TempDir())
+	return sc
+}
+
+// commitFile commits name with contents on the checked out branch of repo.
+func commitFile(t *testing.T, repo *git.Repository, name, contents string) plumbing.Hash {
+	t.Helper()
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(wt.Filesystem.Root(), name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := wt.Commit("add "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func waitForImport(t *testing.T, job *ImportJob) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for job.Running() {
+		if time.Now().After(deadline) {
+			t.Fatal("import didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job.Status() != ImportDone {
+		t.Fatalf("import %s: %s", job.Status(), job.ErrorMessage())
+	}
+}
+
+func importTestMirror(t *testing.T, sc *Smithy, upstream string, creds Credentials) RepositoryWithName {
+	t.Helper()
+	job, err := sc.StartImport(ImportOptions{
+		Name:         "mirror.git",
+		URL:          "file://" + upstream,
+		Mirror:       true,
+		Credentials:  creds,
+		SyncInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForImport(t, job)
+	rwn, ok := sc.FindRepo("mirror.git")
+	if !ok {
+		t.Fatal("mirror not registered")
+	}
+	return rwn
+}
+
+func TestSyncMirrorFromFileUpstream(t *testing.T) {
+	sc := newTestSmithy(t)
+	dir := t.TempDir()
+	upstream, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, upstream, "README", "one\n")
+	head, _ := upstream.Head()
+	if err := upstream.Storer.SetReference(plumbing.NewHashReference("refs/heads/gone", head.Hash())); err != nil {
+		t.Fatal(err)
+	}
+
+	rwn := importTestMirror(t, sc, dir, Credentials{})
+	if _, err := rwn.Repository.Reference("refs/heads/gone", false); err != nil {
+		t.Fatalf("gone not mirrored: %v", err)
+	}
+
+	second := commitFile(t, upstream, "README", "two\n")
+	if err := upstream.Storer.RemoveReference("refs/heads/gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.SyncMirror(rwn); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := rwn.Repository.Reference(head.Name(), false)
+	if err != nil || ref.Hash() != second {
+		t.Fatalf("%s = %v, %v; want %s", head.Name(), ref, err, second)
+	}
+	if _, err := rwn.Repository.Reference("refs/heads/gone", false); err == nil {
+		t.Fatal("ref deleted upstream wasn't pruned")
+	}
+	m, _ := rwn.Mirror()
+	if m.LastError != "" || m.LastSuccess.IsZero() {
+		t.Fatalf("status = %+v", m)
+	}
+}
+
+func TestSyncMirrorFailureIsRecorded(t *testing.T) {
+	sc := newTestSmithy(t)
+	dir := t.TempDir()
+	upstream, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, upstream, "README", "one\n")
+	rwn := importTestMirror(t, sc, dir, Credentials{})
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.SyncMirror(rwn); err == nil {
+		t.Fatal("sync of a missing upstream succeeded")
+	}
+	m, _ := rwn.Mirror()
+	if m.LastError == "" {
+		t.Fatal("error not recorded")
+	}
+}
+
+func TestMirrorCredentialsAreKept(t *testing.T) {
+	sc := newTestSmithy(t)
+	dir := t.TempDir()
+	upstream, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, upstream, "README", "one\n")
+
+	// The file transport ignores the credentials, they only have to survive
+	// the import for the scheduled syncs.
+	creds := Credentials{Username: "bob", Password: "secret"}
+	rwn := importTestMirror(t, sc, dir, creds)
+	got, err := rwn.mirrorCredentials()
+	if err != nil || got != creds {
+		t.Fatalf("credentials = %+v, %v; want %+v", got, err, creds)
+	}
+	fi, err := os.Stat(filepath.Join(rwn.GitDir(), mirrorCredentialsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("credentials file mode %o", perm)
+	}
+	if err := sc.SyncMirror(rwn); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new upstream drops the credentials of the old one.
+	if err := rwn.SetMirror("file://"+t.TempDir(), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := rwn.mirrorCredentials(); got != (Credentials{}) {
+		t.Fatalf("credentials kept after the upstream changed: %+v", got)
+	}
+}
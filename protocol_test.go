@@ -0,0 +1,330 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The protocol tests run the git client against both backends.
+var gitBackends = []string{GitBackendExec, GitBackendGo}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	return runGitEnv(t, dir, nil, args...)
+}
+
+func runGitEnv(t *testing.T, dir string, env []string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), env...),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s%s", strings.Join(args, " "), err, out, stderr.String())
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// writeAndCommit commits contents as name in the work tree dir.
+func writeAndCommit(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	return writeAndCommitAt(t, dir, name, contents, "")
+}
+
+// writeAndCommitAt commits with the given date, or now when it is empty.
+func writeAndCommitAt(t *testing.T, dir, name, contents, date string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var env []string
+	if date != "" {
+		env = []string{"GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_DATE=" + date}
+	}
+	runGit(t, dir, "add", name)
+	runGitEnv(t, dir, env, "commit", "-q", "-m", "change "+name)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+// numberedLines is a file big enough for git to send changes as deltas.
+func numberedLines(n int, changed string) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString("line ")
+		b.WriteString(strings.Repeat("x", i%40))
+		b.WriteString("\n")
+		if i == n/2 {
+			b.WriteString(changed)
+		}
+	}
+	return b.String()
+}
+
+// newProtocolServer serves repo.git, a bare repository with a history of
+// three commits from 2020, 2021 and 2022 and the first tagged v1, with the
+// given backend.
+func newProtocolServer(t *testing.T, backend string) (sc *Smithy, url string) {
+	t.Helper()
+	return newProtocolServerWith(t, backend, UploadPack{})
+}
+
+func newProtocolServerWith(t *testing.T, backend string, opts UploadPack) (sc *Smithy, url string) {
+	t.Helper()
+	sc = NewSmithy(t.TempDir())
+	// Pushes index in the background, the directory may still be written
+	// to when the test ends.
+	index, err := os.MkdirTemp("", "smithy-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(index) })
+	sc.Search = NewSearchIndex(index)
+	cfg := DefaultConfig()
+	cfg.Root = sc.Root
+	cfg.Index = index
+	cfg.GitBackend = backend
+	cfg.UploadPack = opts
+	sc.SetConfig(cfg)
+
+	work := t.TempDir()
+	runGit(t, work, "init", "-q", "-b", "master")
+	writeAndCommitAt(t, work, "big.txt", numberedLines(500, ""), "2020-01-01T00:00:00Z")
+	runGit(t, work, "tag", "v1")
+	writeAndCommitAt(t, work, "README", "one\n", "2021-01-01T00:00:00Z")
+	writeAndCommitAt(t, work, "README", "two\n", "2022-01-01T00:00:00Z")
+	runGit(t, work, "clone", "-q", "--bare", work, filepath.Join(sc.Root, "repo.git"))
+	if err := sc.LoadAllRepositories(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(sc.Handler())
+	t.Cleanup(srv.Close)
+	return sc, srv.URL + "/repo.git"
+}
+
+func serverRef(t *testing.T, sc *Smithy, ref string) string {
+	t.Helper()
+	rwn, ok := sc.FindRepo("repo.git")
+	if !ok {
+		t.Fatal("repo.git not found")
+	}
+	return runGit(t, rwn.Path, "rev-parse", "--verify", "-q", ref)
+}
+
+func TestCloneAndPush(t *testing.T) {
+	for _, backend := range gitBackends {
+		t.Run(backend, func(t *testing.T) {
+			sc, url := newProtocolServer(t, backend)
+			dir := filepath.Join(t.TempDir(), "clone")
+			runGit(t, "", "clone", "-q", url, dir)
+			if got, want := runGit(t, dir, "rev-parse", "HEAD"), serverRef(t, sc, "master"); got != want {
+				t.Fatalf("cloned HEAD %s, want %s", got, want)
+			}
+			runGit(t, dir, "fsck", "--strict")
+
+			// Editing a file the server has makes git send a thin pack,
+			// with deltas against objects that aren't in it.
+			head := writeAndCommit(t, dir, "big.txt", numberedLines(500, "changed\n"))
+			runGit(t, dir, "push", "-q", "origin", "master")
+			if got := serverRef(t, sc, "master"); got != head {
+				t.Fatalf("server master %s after push, want %s", got, head)
+			}
+
+			runGit(t, dir, "push", "-q", "origin", "master:refs/heads/topic")
+			if got := serverRef(t, sc, "topic"); got != head {
+				t.Fatalf("server topic %s, want %s", got, head)
+			}
+			runGit(t, dir, "push", "-q", "origin", ":topic")
+			if out := runGit(t, sc.Root, "--git-dir", "repo.git", "for-each-ref", "refs/heads/topic"); out != "" {
+				t.Fatalf("topic not deleted: %s", out)
+			}
+			rwn, _ := sc.FindRepo("repo.git")
+			runGit(t, rwn.Path, "fsck", "--strict")
+		})
+	}
+}
+
+func TestFetchAfterPush(t *testing.T) {
+	for _, backend := range gitBackends {
+		t.Run(backend, func(t *testing.T) {
+			_, url := newProtocolServer(t, backend)
+			a := filepath.Join(t.TempDir(), "a")
+			b := filepath.Join(t.TempDir(), "b")
+			runGit(t, "", "clone", "-q", url, a)
+			runGit(t, "", "clone", "-q", url, b)
+
+			writeAndCommit(t, a, "README", "three\n")
+			head := writeAndCommit(t, a, "big.txt", numberedLines(500, "fetched\n"))
+			runGit(t, a, "push", "-q", "origin", "master")
+
+			// b has most of the history, the fetch negotiates what is new.
+			runGit(t, b, "fetch", "-q", "origin")
+			if got := runGit(t, b, "rev-parse", "origin/master"); got != head {
+				t.Fatalf("fetched origin/master %s, want %s", got, head)
+			}
+			runGit(t, b, "fsck", "--strict")
+		})
+	}
+}
+
+func commitCount(t *testing.T, dir string) string {
+	t.Helper()
+	return runGit(t, dir, "rev-list", "--count", "HEAD")
+}
+
+// missingObjects counts the objects a partial clone left out.
+func missingObjects(t *testing.T, dir string) int {
+	t.Helper()
+	out := runGit(t, dir, "rev-list", "--objects", "--missing=print", "--all")
+	return strings.Count(out, "\n?") + strings.Count(out[:1], "?")
+}
+
+func TestShallowClone(t *testing.T) {
+	for _, backend := range gitBackends {
+		t.Run(backend, func(t *testing.T) {
+			_, url := newProtocolServer(t, backend)
+			dir := filepath.Join(t.TempDir(), "clone")
+			runGit(t, "", "clone", "-q", "--depth", "1", url, dir)
+			if n := commitCount(t, dir); n != "1" {
+				t.Fatalf("--depth 1 cloned %s commits", n)
+			}
+			runGit(t, dir, "fsck")
+
+			runGit(t, dir, "fetch", "-q", "--depth", "2", "origin")
+			if n := commitCount(t, dir); n != "2" {
+				t.Fatalf("--depth 2 deepened to %s commits", n)
+			}
+
+			// A push to a shallow history keeps it shallow.
+			writeAndCommit(t, dir, "README", "three\n")
+			runGit(t, dir, "push", "-q", "origin", "HEAD:master")
+			runGit(t, dir, "fetch", "-q", "origin")
+
+			runGit(t, dir, "fetch", "-q", "--unshallow", "origin")
+			if n := commitCount(t, dir); n != "4" {
+				t.Fatalf("--unshallow left %s commits", n)
+			}
+			if _, err := os.Stat(filepath.Join(dir, ".git", "shallow")); !os.IsNotExist(err) {
+				t.Fatalf("still shallow: %v", err)
+			}
+			runGit(t, dir, "fsck", "--strict")
+		})
+	}
+}
+
+func TestShallowSinceAndExclude(t *testing.T) {
+	for _, backend := range gitBackends {
+		t.Run(backend, func(t *testing.T) {
+			_, url := newProtocolServer(t, backend)
+			since := filepath.Join(t.TempDir(), "since")
+			runGit(t, "", "clone", "-q", "--shallow-since=2020-06-01", url, since)
+			if n := commitCount(t, since); n != "2" {
+				t.Fatalf("--shallow-since cloned %s commits", n)
+			}
+			runGit(t, since, "fsck")
+
+			exclude := filepath.Join(t.TempDir(), "exclude")
+			runGit(t, "", "clone", "-q", "--shallow-exclude=v1", url, exclude)
+			if n := commitCount(t, exclude); n != "2" {
+				t.Fatalf("--shallow-exclude cloned %s commits", n)
+			}
+			runGit(t, exclude, "fsck")
+		})
+	}
+}
+
+func TestPartialClone(t *testing.T) {
+	for _, backend := range gitBackends {
+		t.Run(backend, func(t *testing.T) {
+			_, url := newProtocolServer(t, backend)
+			dir := filepath.Join(t.TempDir(), "clone")
+			runGit(t, "", "clone", "-q", "--filter=blob:none", "--no-checkout", url, dir)
+			if n := missingObjects(t, dir); n != 3 {
+				t.Fatalf("blob:none left out %d blobs, want 3", n)
+			}
+			// Missing blobs are fetched by id when they are needed.
+			runGit(t, dir, "checkout", "-q", "master")
+			if got := runGit(t, dir, "show", "HEAD~1:README"); got != "one" {
+				t.Fatalf("README was %q", got)
+			}
+
+			limit := filepath.Join(t.TempDir(), "limit")
+			runGit(t, "", "clone", "-q", "--filter=blob:limit=1k", "--no-checkout", url, limit)
+			if n := missingObjects(t, limit); n != 1 {
+				t.Fatalf("blob:limit=1k left out %d blobs, want 1", n)
+			}
+		})
+	}
+}
+
+func TestFiltersNotAllowed(t *testing.T) {
+	off := false
+	for _, backend := range gitBackends {
+		t.Run(backend, func(t *testing.T) {
+			_, url := newProtocolServerWith(t, backend, UploadPack{AllowFilter: &off})
+			dir := filepath.Join(t.TempDir(), "clone")
+			// The client ignores the filter and clones everything.
+			runGit(t, "", "clone", "-q", "--filter=blob:none", url, dir)
+			if n := missingObjects(t, dir); n != 0 {
+				t.Fatalf("%d objects missing", n)
+			}
+		})
+	}
+}
+
+func TestAnySHA1InWantIsOffByDefault(t *testing.T) {
+	var opts UploadPack
+	if opts.AnySHA1InWantAllowed() || !opts.ReachableSHA1InWantAllowed() || !opts.FilterAllowed() {
+		t.Fatalf("defaults: any %v, reachable %v, filter %v",
+			opts.AnySHA1InWantAllowed(), opts.ReachableSHA1InWantAllowed(), opts.FilterAllowed())
+	}
+}
+
+func TestPrivateRepository(t *testing.T) {
+	for _, backend := range gitBackends {
+		t.Run(backend, func(t *testing.T) {
+			sc, url := newProtocolServer(t, backend)
+			cfg := *sc.Config()
+			cfg.AdminToken = "secret"
+			sc.SetConfig(&cfg)
+			rwn, _ := sc.FindRepo("repo.git")
+			if err := rwn.SetVisibility(VisibilityPrivate); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range []string{"", "/tree/", "/info/refs?service=git-upload-pack", "/HEAD", "/api/releases"} {
+				resp, err := http.Get(url + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("GET %s: %s, want 401", path, resp.Status)
+				}
+			}
+			dir := filepath.Join(t.TempDir(), "clone")
+			cmd := exec.Command("git", "clone", "-q", url, dir)
+			cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=/dev/null")
+			if out, err := cmd.CombinedOutput(); err == nil {
+				t.Fatalf("cloned without the token: %s", out)
+			}
+
+			authed := strings.Replace(url, "http://", "http://admin:secret@", 1)
+			runGit(t, "", "clone", "-q", authed, dir)
+			writeAndCommit(t, dir, "README", "private\n")
+			runGit(t, dir, "push", "-q", "origin", "master")
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	pushTimeout       = 10 * time.Minute
+	maxPushRetries    = 5
+	pushRetryDelay    = 10 * time.Second
+	maxPushLogEntries = 20
+)
+
+// PushMirror is a remote every push to the repository is replicated to. It
+// is a plain git remote with mirror = true, as git remote add --mirror=push
+// writes it.
+type PushMirror struct {
+	Name string
+	URL  string
+}
+
+func (rwn RepositoryWithName) PushMirrors() []PushMirror {
+	cfg, err := rwn.Repository.Config()
+	if err != nil {
+		return nil
+	}
+	var mirrors []PushMirror
+	for name, remote := range cfg.Remotes {
+		if len(remote.URLs) == 0 {
+			continue
+		}
+		if !isPushMirror(cfg, name) {
+			continue
+		}
+		mirrors = append(mirrors, PushMirror{Name: name, URL: remote.URLs[0]})
+	}
+	sort.Slice(mirrors, func(i, j int) bool { return mirrors[i].Name < mirrors[j].Name })
+	return mirrors
+}
+
+// isPushMirror reports whether the remote name is a push mirror. The origin
+// of git clone --mirror is marked mirror as well but fetches every ref, it
+// belongs to a pull mirror.
+func isPushMirror(cfg *config.Config, name string) bool {
+	remote, exists := cfg.Remotes[name]
+	if !exists || cfg.Raw.Section("remote").Subsection(name).Option("mirror") != "true" {
+		return false
+	}
+	for _, spec := range remote.Fetch {
+		if spec == mirrorRefSpec {
+			return false
+		}
+	}
+	return true
+}
+
+func (rwn RepositoryWithName) AddPushMirror(name, url string) error {
+	if !repoNameSegment.MatchString(name) {
+		return fmt.Errorf("invalid remote name %q", name)
+	}
+	if _, err := transport.NewEndpoint(url); err != nil {
+		return err
+	}
+	cfg, err := rwn.Repository.Config()
+	if err != nil {
+		return err
+	}
+	if _, exists := cfg.Remotes[name]; exists {
+		return fmt.Errorf("remote %s already exists", name)
+	}
+	cfg.Remotes[name] = &config.RemoteConfig{Name: name, URLs: []string{url}}
+	if err := rwn.Repository.SetConfig(cfg); err != nil {
+		return err
+	}
+	// The raw subsection only exists once the remote has been written.
+	cfg, err = rwn.Repository.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Raw.Section("remote").Subsection(name).SetOption("mirror", "true")
+	return rwn.Repository.SetConfig(cfg)
+}
+
+func (rwn RepositoryWithName) RemovePushMirror(name string) error {
+	cfg, err := rwn.Repository.Config()
+	if err != nil {
+		return err
+	}
+	// Other remotes, like the origin of a clone, aren't managed here.
+	if !isPushMirror(cfg, name) {
+		return fmt.Errorf("push mirror %s not found", name)
+	}
+	delete(cfg.Remotes, name)
+	return rwn.Repository.SetConfig(cfg)
+}
+
+// RefSnapshot maps every direct reference of repo to its target, to find
+// out what a push changed.
+func RefSnapshot(repo *git.Repository) map[plumbing.ReferenceName]plumbing.Hash {
+	refs := make(map[plumbing.ReferenceName]plumbing.Hash)
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return refs
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	return refs
+}
+
+// ChangedRefs lists the references that were created, moved or deleted
+// between two snapshots.
+func ChangedRefs(before, after map[plumbing.ReferenceName]plumbing.Hash) []plumbing.ReferenceName {
+	var changed []plumbing.ReferenceName
+	for name, hash := range after {
+		if before[name] != hash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+type PushLogEntry struct {
+	Time    time.Time
+	Message string
+}
+
+// PushStatus is the replication state of one push mirror. It lives in
+// memory and starts over when the server restarts.
+type PushStatus struct {
+	PushMirror
+	Running     bool
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string
+	Log         []PushLogEntry
+}
+
+func (ps *PushStatus) logf(format string, args ...any) {
+	ps.Log = append(ps.Log, PushLogEntry{Time: time.Now(), Message: fmt.Sprintf(format, args...)})
+	if len(ps.Log) > maxPushLogEntries {
+		ps.Log = ps.Log[len(ps.Log)-maxPushLogEntries:]
+	}
+}
+
+type pushState struct {
+	status  PushStatus
+	pending map[plumbing.ReferenceName]bool
+	all     bool
+}
+
+// PushQueue replicates pushes to push mirrors in the background. Updates
+// queued while a push is running are coalesced into the next one.
+type PushQueue struct {
+	mu     sync.Mutex
+	states map[string]*pushState
+}
+
+func NewPushQueue() *PushQueue {
+	return &PushQueue{states: make(map[string]*pushState)}
+}
+
+func pushKey(repo, remote string) string {
+	return repo + "\x00" + remote
+}
+
+// Status returns a copy of the state of every push mirror of rwn.
+func (pq *PushQueue) Status(rwn RepositoryWithName) []PushStatus {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	var statuses []PushStatus
+	for _, mirror := range rwn.PushMirrors() {
+		status := PushStatus{PushMirror: mirror}
+		if state, ok := pq.states[pushKey(rwn.Name, mirror.Name)]; ok {
+			status = state.status
+			status.PushMirror = mirror
+			status.Log = append([]PushLogEntry(nil), state.status.Log...)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// QueuePush replicates refs to every push mirror of rwn. No refs means all
+// of them, pruning what was deleted locally.
+func (sc *Smithy) QueuePush(rwn RepositoryWithName, refs []plumbing.ReferenceName) {
+	if !sc.Config().For(rwn.Name).Features.MirrorsEnabled() {
+		return
+	}
+	for _, mirror := range rwn.PushMirrors() {
+		sc.queuePush(rwn, mirror, refs)
+	}
+}
+
+func (sc *Smithy) queuePush(rwn RepositoryWithName, mirror PushMirror, refs []plumbing.ReferenceName) {
+	pq := sc.pushes
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	key := pushKey(rwn.Name, mirror.Name)
+	state, ok := pq.states[key]
+	if !ok {
+		state = &pushState{pending: make(map[plumbing.ReferenceName]bool)}
+		pq.states[key] = state
+	}
+	if len(refs) == 0 {
+		state.all = true
+	}
+	for _, ref := range refs {
+		state.pending[ref] = true
+	}
+	if state.status.Running {
+		return
+	}
+	state.status.Running = true
+	go sc.runPush(rwn, mirror, state)
+}
+
+// runPush pushes until nothing is pending, retrying failures with an
+// exponential backoff.
+func (sc *Smithy) runPush(rwn RepositoryWithName, mirror PushMirror, state *pushState) {
+	pq := sc.pushes
+	for {
+		pq.mu.Lock()
+		if !state.all && len(state.pending) == 0 {
+			state.status.Running = false
+			pq.mu.Unlock()
+			return
+		}
+		all, pending := state.all, state.pending
+		state.all, state.pending = false, make(map[plumbing.ReferenceName]bool)
+		pq.mu.Unlock()
+
+		delay := pushRetryDelay
+		for attempt := 1; ; attempt++ {
+			err := pushToMirror(rwn.Repository, mirror, all, pending)
+			pq.mu.Lock()
+			state.status.LastAttempt = time.Now()
+			if err == nil {
+				state.status.LastSuccess = state.status.LastAttempt
+				state.status.LastError = ""
+				state.status.logf("pushed %s", describePush(all, pending))
+			} else {
+				state.status.LastError = err.Error()
+				state.status.logf("attempt %d: %v", attempt, err)
+			}
+			pq.mu.Unlock()
+			if err == nil {
+				break
+			}
+			log.Printf("push mirror: %s to %s: %v", rwn.Name, mirror.Name, err)
+			// A removed mirror won't come back by waiting.
+			if attempt == maxPushRetries || errors.Is(err, git.ErrRemoteNotFound) {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func describePush(all bool, pending map[plumbing.ReferenceName]bool) string {
+	if all {
+		return "all refs"
+	}
+	if len(pending) == 1 {
+		for name := range pending {
+			return name.String()
+		}
+	}
+	return fmt.Sprintf("%d refs", len(pending))
+}
+
+func pushToMirror(repo *git.Repository, mirror PushMirror, all bool, pending map[plumbing.ReferenceName]bool) error {
+	opts := &git.PushOptions{
+		RemoteName: mirror.Name,
+		Force:      true,
+	}
+	if all {
+		opts.RefSpecs = []config.RefSpec{mirrorRefSpec}
+		opts.Prune = true
+	} else {
+		for name := range pending {
+			if _, err := repo.Storer.Reference(name); err == nil {
+				opts.RefSpecs = append(opts.RefSpecs, config.RefSpec("+"+name+":"+name))
+			} else {
+				opts.RefSpecs = append(opts.RefSpecs, config.RefSpec(":"+name))
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+	err := repo.PushContext(ctx, opts)
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+func TestRemovePushMirrorKeepsOtherRemotes(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rwn := RepositoryWithName{Name: "repo.git", Repository: repo, Path: dir}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{"https://example.com/repo.git"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The origin of git clone --mirror.
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name:  "upstream",
+		URLs:  []string{"https://example.com/upstream.git"},
+		Fetch: []config.RefSpec{mirrorRefSpec},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := repo.Config()
+	cfg.Raw.Section("remote").Subsection("upstream").SetOption("mirror", "true")
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := rwn.AddPushMirror("backup", "https://example.com/backup.git"); err != nil {
+		t.Fatal(err)
+	}
+
+	if mirrors := rwn.PushMirrors(); len(mirrors) != 1 || mirrors[0].Name != "backup" {
+		t.Fatalf("push mirrors = %v", mirrors)
+	}
+	for _, name := range []string{"origin", "upstream", "missing"} {
+		if err := rwn.RemovePushMirror(name); err == nil {
+			t.Errorf("removed %s", name)
+		}
+	}
+	if err := rwn.RemovePushMirror("backup"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ = repo.Config()
+	if len(cfg.Remotes) != 2 || cfg.Remotes["backup"] != nil {
+		t.Fatalf("remotes = %v", cfg.Remotes)
+	}
+}
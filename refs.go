@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Branch is a branch reference together with the commit it points at.
+type Branch struct {
+	Reference *plumbing.Reference
+	Commit    *object.Commit
+	Subject   string
+	Signature Signature
+}
+
+func (b *Branch) Age() string {
+	return HumanizeAge(b.Commit.Committer.When)
+}
+
+// Tag is a tag reference. Annotated tags carry their tag object, lightweight
+// tags only have the commit they point at.
+type Tag struct {
+	Reference *plumbing.Reference
+	Object    *object.Tag
+	Commit    *object.Commit
+	Signature Signature
+}
+
+func (t *Tag) IsAnnotated() bool {
+	return t.Object != nil
+}
+
+// Date is the tagger date for annotated tags and the commit date otherwise.
+func (t *Tag) Date() time.Time {
+	if t.Object != nil {
+		return t.Object.Tagger.When
+	}
+	if t.Commit != nil {
+		return t.Commit.Committer.When
+	}
+	return time.Time{}
+}
+
+func (t *Tag) Age() string {
+	return HumanizeAge(t.Date())
+}
+
+func (t *Tag) Message() string {
+	if t.Object == nil {
+		return ""
+	}
+	return strings.TrimSpace(t.Object.Message)
+}
+
+type TagsByDate []*Tag
+
+func (t TagsByDate) Len() int      { return len(t) }
+func (t TagsByDate) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t TagsByDate) Less(i, j int) bool {
+	return t[i].Date().After(t[j].Date())
+}
+
+// TagsBySemver orders tags by semantic version, newest first. Tags that are
+// not versions sort after all versions, by name.
+type TagsBySemver []*Tag
+
+func (t TagsBySemver) Len() int      { return len(t) }
+func (t TagsBySemver) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t TagsBySemver) Less(i, j int) bool {
+	a, aok := ParseSemver(t[i].Reference.Name().Short())
+	b, bok := ParseSemver(t[j].Reference.Name().Short())
+	switch {
+	case aok && bok:
+		return CompareSemver(a, b) > 0
+	case aok != bok:
+		return aok
+	}
+	return strings.Compare(t[i].Reference.Name().Short(), t[j].Reference.Name().Short()) < 0
+}
+
+type Semver struct {
+	Major, Minor, Patch int
+	Prerelease          string
+}
+
+// ParseSemver accepts versions like "v1.2.3", "1.2" or "v2.0.0-rc.1".
+func ParseSemver(s string) (Semver, bool) {
+	var v Semver
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.Prerelease = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return v, false
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+func CompareSemver(a, b Semver) int {
+	for _, d := range []int{a.Major - b.Major, a.Minor - b.Minor, a.Patch - b.Patch} {
+		if d != 0 {
+			return d
+		}
+	}
+	switch {
+	case a.Prerelease == b.Prerelease:
+		return 0
+	case a.Prerelease == "":
+		return 1
+	case b.Prerelease == "":
+		return -1
+	}
+	return strings.Compare(a.Prerelease, b.Prerelease)
+}
+
+func HumanizeAge(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	d := time.Since(t)
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit + " ago"
+		}
+		return strconv.Itoa(n) + " " + unit + "s ago"
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d.Minutes()), "minute")
+	case d < 24*time.Hour:
+		return plural(int(d.Hours()), "hour")
+	case d < 30*24*time.Hour:
+		return plural(int(d.Hours()/24), "day")
+	case d < 365*24*time.Hour:
+		return plural(int(d.Hours()/24/30), "month")
+	}
+	return plural(int(d.Hours()/24/365), "year")
+}
+
+// PeelToCommit resolves a reference hash to a commit, following annotated
+// tags. The tag object is returned when one was traversed.
+func PeelToCommit(repo *git.Repository, hash plumbing.Hash) (*object.Commit, *object.Tag, error) {
+	tag, err := repo.TagObject(hash)
+	if err == nil {
+		commit, err := tag.Commit()
+		return commit, tag, err
+	}
+	if !errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, nil, err
+	}
+	commit, err := repo.CommitObject(hash)
+	return commit, nil, err
+}
+
+func ListBranchDetails(repo *git.Repository) ([]*Branch, error) {
+	refs, err := ListBranches(repo)
+	if err != nil {
+		return nil, err
+	}
+	var branches []*Branch
+	for _, ref := range refs {
+		commit, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			return branches, err
+		}
+		branches = append(branches, &Branch{
+			Reference: ref,
+			Commit:    commit,
+			Subject:   strings.Split(commit.Message, "\n")[0],
+		})
+	}
+	return branches, nil
+}
+
+func ListTagDetails(repo *git.Repository) ([]*Tag, error) {
+	refs, err := ListTags(repo)
+	if err != nil {
+		return nil, err
+	}
+	var tags []*Tag
+	for _, ref := range refs {
+		t := &Tag{Reference: ref}
+		// Tags pointing at trees or blobs are listed without a commit.
+		t.Commit, t.Object, _ = PeelToCommit(repo, ref.Hash())
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// Decorations maps each commit to the branches and tags pointing at it.
+func Decorations(repo *git.Repository) (map[plumbing.Hash][]*plumbing.Reference, error) {
+	decorations := make(map[plumbing.Hash][]*plumbing.Reference)
+	branches, err := ListBranches(repo)
+	if err != nil {
+		return decorations, err
+	}
+	for _, ref := range branches {
+		decorations[ref.Hash()] = append(decorations[ref.Hash()], ref)
+	}
+	tags, err := ListTags(repo)
+	if err != nil {
+		return decorations, err
+	}
+	for _, ref := range tags {
+		hash := ref.Hash()
+		if commit, _, err := PeelToCommit(repo, hash); err == nil {
+			hash = commit.Hash
+		}
+		decorations[hash] = append(decorations[hash], ref)
+	}
+	return decorations, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type RegistryEventKind int
+
+const (
+	RepoAdded RegistryEventKind = iota
+	RepoRemoved
+	RepoRenamed
+)
+
+// RegistryEvent describes a change to the registry. OldName is only set
+// when a repository was renamed.
+type RegistryEvent struct {
+	Kind    RegistryEventKind
+	Repo    RepositoryWithName
+	OldName string
+}
+
+// Registry holds the repositories being served. It is safe for concurrent
+// use, every change is applied under a single lock and then published to
+// the subscribers, in the order the changes happened.
+type Registry struct {
+	mu          sync.RWMutex
+	repos       map[string]RepositoryWithName
+	publish     sync.Mutex
+	subscribers []func(RegistryEvent)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{repos: make(map[string]RepositoryWithName)}
+}
+
+// Subscribe calls fn after every change. Subscribers run synchronously and
+// must not modify the registry.
+func (reg *Registry) Subscribe(fn func(RegistryEvent)) {
+	reg.publish.Lock()
+	defer reg.publish.Unlock()
+	reg.subscribers = append(reg.subscribers, fn)
+}
+
+// change applies fn under the write lock and publishes the events it
+// returns. The publish lock is taken first so events can't overtake each
+// other.
+func (reg *Registry) change(fn func() []RegistryEvent) {
+	reg.publish.Lock()
+	defer reg.publish.Unlock()
+	reg.mu.Lock()
+	events := fn()
+	reg.mu.Unlock()
+	for _, event := range events {
+		for _, subscriber := range reg.subscribers {
+			subscriber(event)
+		}
+	}
+}
+
+// Get looks a repository up by its exact name.
+func (reg *Registry) Get(name string) (RepositoryWithName, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	rwn, exists := reg.repos[name]
+	return rwn, exists
+}
+
+// Find looks a repository up by name, with or without its .git suffix.
+func (reg *Registry) Find(slug string) (RepositoryWithName, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	if value, exists := reg.repos[slug]; exists {
+		return value, exists
+	}
+	if strings.HasSuffix(slug, ".git") {
+		value, exists := reg.repos[strings.TrimSuffix(slug, ".git")]
+		return value, exists
+	}
+	value, exists := reg.repos[slug+".git"]
+	return value, exists
+}
+
+// List returns a snapshot of all repositories sorted by name.
+func (reg *Registry) List() []RepositoryWithName {
+	reg.mu.RLock()
+	repos := make([]RepositoryWithName, 0, len(reg.repos))
+	for _, repo := range reg.repos {
+		repos = append(repos, repo)
+	}
+	reg.mu.RUnlock()
+	sort.Sort(RepositoryByName(repos))
+	return repos
+}
+
+func (reg *Registry) Len() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return len(reg.repos)
+}
+
+// Add inserts rwn, replacing a repository of the same name.
+func (reg *Registry) Add(rwn RepositoryWithName) {
+	reg.change(func() []RegistryEvent {
+		reg.repos[rwn.Name] = rwn
+		return []RegistryEvent{{Kind: RepoAdded, Repo: rwn}}
+	})
+}
+
+// AddIfAbsent inserts rwn unless its name is taken and reports whether it
+// did.
+func (reg *Registry) AddIfAbsent(rwn RepositoryWithName) (added bool) {
+	reg.change(func() []RegistryEvent {
+		if _, exists := reg.repos[rwn.Name]; exists {
+			return nil
+		}
+		reg.repos[rwn.Name] = rwn
+		added = true
+		return []RegistryEvent{{Kind: RepoAdded, Repo: rwn}}
+	})
+	return added
+}
+
+func (reg *Registry) Remove(name string) bool {
+	return reg.RemoveIf(name, func(RepositoryWithName) bool { return true })
+}
+
+// RemoveIf removes the named repository if cond, evaluated under the lock,
+// holds for it.
+func (reg *Registry) RemoveIf(name string, cond func(RepositoryWithName) bool) (removed bool) {
+	reg.change(func() []RegistryEvent {
+		rwn, exists := reg.repos[name]
+		if !exists || !cond(rwn) {
+			return nil
+		}
+		delete(reg.repos, name)
+		removed = true
+		return []RegistryEvent{{Kind: RepoRemoved, Repo: rwn}}
+	})
+	return removed
+}
+
+// Rename replaces oldName with renamed in one step. It fails if the new
+// name belongs to another repository.
+func (reg *Registry) Rename(oldName string, renamed RepositoryWithName) (err error) {
+	reg.change(func() []RegistryEvent {
+		if _, exists := reg.repos[oldName]; !exists {
+			err = fmt.Errorf("repository %s not found", oldName)
+			return nil
+		}
+		// A rescan may have picked up the new path already.
+		if other, exists := reg.repos[renamed.Name]; exists && other.Path != renamed.Path {
+			err = fmt.Errorf("repository %s already exists", renamed.Name)
+			return nil
+		}
+		delete(reg.repos, oldName)
+		reg.repos[renamed.Name] = renamed
+		return []RegistryEvent{{Kind: RepoRenamed, Repo: renamed, OldName: oldName}}
+	})
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// TestRegistryConcurrentChanges is meant for go test -race. The subscriber
+// must see the changes in the order they were applied, replaying them ends
+// in the state of the registry.
+func TestRegistryConcurrentChanges(t *testing.T) {
+	reg := NewRegistry()
+	seen := make(map[string]bool)
+	reg.Subscribe(func(event RegistryEvent) {
+		switch event.Kind {
+		case RepoAdded:
+			seen[event.Repo.Name] = true
+		case RepoRemoved:
+			delete(seen, event.Repo.Name)
+		case RepoRenamed:
+			delete(seen, event.OldName)
+			seen[event.Repo.Name] = true
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				name := fmt.Sprintf("repo%d", j%10)
+				renamed := fmt.Sprintf("renamed%d", j%10)
+				switch (i + j) % 5 {
+				case 0:
+					reg.Add(RepositoryWithName{Name: name, Path: name})
+				case 1:
+					reg.AddIfAbsent(RepositoryWithName{Name: name, Path: name})
+				case 2:
+					reg.Rename(name, RepositoryWithName{Name: renamed, Path: renamed})
+				case 3:
+					reg.RemoveIf(renamed, func(rwn RepositoryWithName) bool { return rwn.Path == renamed })
+				case 4:
+					reg.Find(name)
+					reg.List()
+					reg.Len()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	repos := reg.List()
+	if len(repos) != len(seen) {
+		t.Fatalf("registry has %d repositories, events %d", len(repos), len(seen))
+	}
+	for _, repo := range repos {
+		if !seen[repo.Name] {
+			t.Errorf("%s missing from the events", repo.Name)
+		}
+	}
+}
+
+func TestRenameRejectsTakenName(t *testing.T) {
+	reg := NewRegistry()
+	reg.Add(RepositoryWithName{Name: "a", Path: "a"})
+	reg.Add(RepositoryWithName{Name: "b", Path: "b"})
+	if err := reg.Rename("a", RepositoryWithName{Name: "b", Path: "c"}); err == nil {
+		t.Fatal("renamed onto another repository")
+	}
+	if err := reg.Rename("missing", RepositoryWithName{Name: "d", Path: "d"}); err == nil {
+		t.Fatal("renamed a missing repository")
+	}
+	if reg.Len() != 2 {
+		t.Fatalf("registry changed: %v", reg.List())
+	}
+}
+
+// TestRescanDuringReload runs rescans, config reloads and lookups at once,
+// like the watcher, SIGHUP and requests do.
+func TestRescanDuringReload(t *testing.T) {
+	sc := newTestSmithy(t)
+	for i := 0; i < 5; i++ {
+		if _, err := git.PlainInit(filepath.Join(sc.Root, fmt.Sprintf("repo%d.git", i)), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sc.Repositories().Subscribe(sc.onRepositoryChange)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := sc.Rescan(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				cfg := DefaultConfig()
+				cfg.Root = sc.Root
+				sc.SetConfig(cfg)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, repo := range sc.GetRepositories() {
+					sc.Config().For(repo.Name)
+					sc.FindRepo(repo.Name)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := sc.Repositories().Len(); n != 5 {
+		t.Fatalf("%d repositories after the rescans, want 5", n)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// maxAssetSize caps a single uploaded release asset.
+const maxAssetSize = 2 << 30
+
+var (
+	ErrReleaseNotFound = errors.New("release not found")
+	ErrReleaseExists   = errors.New("release already exists")
+	ErrAssetNotFound   = errors.New("asset not found")
+)
+
+// releaseMu serializes changes to release metadata, uploads of different
+// assets may run at the same time.
+var releaseMu sync.Mutex
+
+// Release is a tag with notes and downloads. Releases live next to the
+// objects in the releases directory of the repository, one directory per
+// tag holding release.json and the assets.
+type Release struct {
+	Tag        string         `json:"tag"`
+	Title      string         `json:"title"`
+	Notes      string         `json:"notes"`
+	Prerelease bool           `json:"prerelease"`
+	Created    time.Time      `json:"created"`
+	Assets     []ReleaseAsset `json:"assets"`
+}
+
+type ReleaseAsset struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// Name is the title of the release, the tag when it has none.
+func (rel *Release) Name() string {
+	if rel.Title != "" {
+		return rel.Title
+	}
+	return rel.Tag
+}
+
+func (rel *Release) Age() string {
+	return HumanizeAge(rel.Created)
+}
+
+func (rel *Release) Asset(name string) (ReleaseAsset, bool) {
+	for _, asset := range rel.Assets {
+		if asset.Name == name {
+			return asset, true
+		}
+	}
+	return ReleaseAsset{}, false
+}
+
+// Checksums is the sha256sum style listing of the assets.
+func (rel *Release) Checksums() string {
+	var b strings.Builder
+	for _, asset := range rel.Assets {
+		fmt.Fprintf(&b, "%s  %s\n", asset.SHA256, asset.Name)
+	}
+	return b.String()
+}
+
+// ArchiveName is the base name of the source archives, repo-tag.
+func (rel *Release) ArchiveName(repo string) string {
+	base := strings.TrimSuffix(filepath.Base(repo), ".git")
+	return base + "-" + strings.ReplaceAll(rel.Tag, "/", "-")
+}
+
+func (rwn RepositoryWithName) releasesDir() string {
+	return filepath.Join(rwn.GitDir(), "releases")
+}
+
+// validateTagName applies the rules of git check-ref-format to a tag name,
+// before it becomes a ref and a directory below releases.
+func validateTagName(tag string) error {
+	invalid := tag == "" || tag == "@" || strings.HasPrefix(tag, "-") ||
+		strings.HasSuffix(tag, ".") || strings.Contains(tag, "..") || strings.Contains(tag, "@{") ||
+		strings.ContainsAny(tag, " ~^:?*[\\\x7f")
+	for _, r := range tag {
+		invalid = invalid || r < ' '
+	}
+	for _, component := range strings.Split(tag, "/") {
+		invalid = invalid || component == "" || strings.HasPrefix(component, ".") ||
+			strings.HasSuffix(component, ".lock")
+	}
+	if invalid {
+		return fmt.Errorf("invalid tag name %q", tag)
+	}
+	return nil
+}
+
+// releaseDir escapes the tag, tag names may contain slashes.
+func (rwn RepositoryWithName) releaseDir(tag string) string {
+	return filepath.Join(rwn.releasesDir(), url.PathEscape(tag))
+}
+
+func (rwn RepositoryWithName) Releases() ([]*Release, error) {
+	entries, err := os.ReadDir(rwn.releasesDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var releases []*Release
+	for _, entry := range entries {
+		tag, err := url.PathUnescape(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		rel, err := rwn.Release(tag)
+		if err != nil {
+			continue
+		}
+		releases = append(releases, rel)
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		return releases[i].Created.After(releases[j].Created)
+	})
+	return releases, nil
+}
+
+func (rwn RepositoryWithName) Release(tag string) (*Release, error) {
+	// No release can have a tag that isn't valid, nor be read through one.
+	if validateTagName(tag) != nil {
+		return nil, ErrReleaseNotFound
+	}
+	b, err := os.ReadFile(filepath.Join(rwn.releaseDir(tag), "release.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrReleaseNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rel Release
+	if err := json.Unmarshal(b, &rel); err != nil {
+		return nil, fmt.Errorf("release %s: %w", tag, err)
+	}
+	return &rel, nil
+}
+
+// LatestRelease is the newest release that isn't a pre-release.
+func (rwn RepositoryWithName) LatestRelease() *Release {
+	releases, _ := rwn.Releases()
+	for _, rel := range releases {
+		if !rel.Prerelease {
+			return rel
+		}
+	}
+	return nil
+}
+
+func (rwn RepositoryWithName) writeRelease(rel *Release) error {
+	dir := rwn.releaseDir(rel.Tag)
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(rel, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "release.json.tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "release.json"))
+}
+
+// CreateRelease publishes a release of an existing tag. With a target the
+// tag is created first, pointing at that revision.
+func (rwn RepositoryWithName) CreateRelease(rel Release, target string) (*Release, error) {
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+	if rel.Tag == "" {
+		return nil, errors.New("a release needs a tag")
+	}
+	if err := validateTagName(rel.Tag); err != nil {
+		return nil, err
+	}
+	if _, err := rwn.Release(rel.Tag); err == nil {
+		return nil, ErrReleaseExists
+	}
+	refName := plumbing.NewTagReferenceName(rel.Tag)
+	if _, err := rwn.Repository.Reference(refName, false); err != nil {
+		if target == "" {
+			return nil, fmt.Errorf("tag %s not found", rel.Tag)
+		}
+		hash, err := ResolveRevision(rwn.Repository, target)
+		if err != nil {
+			return nil, err
+		}
+		if err := rwn.Repository.Storer.SetReference(plumbing.NewHashReference(refName, *hash)); err != nil {
+			return nil, err
+		}
+	}
+	rel.Created = time.Now().UTC()
+	rel.Assets = nil
+	if err := rwn.writeRelease(&rel); err != nil {
+		return nil, err
+	}
+	return &rel, nil
+}
+
+// UpdateRelease changes the title, notes and pre-release flag.
+func (rwn RepositoryWithName) UpdateRelease(tag, title, notes string, prerelease bool) (*Release, error) {
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+	rel, err := rwn.Release(tag)
+	if err != nil {
+		return nil, err
+	}
+	rel.Title, rel.Notes, rel.Prerelease = title, notes, prerelease
+	return rel, rwn.writeRelease(rel)
+}
+
+// DeleteRelease removes the release and its assets, the tag stays.
+func (rwn RepositoryWithName) DeleteRelease(tag string) error {
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+	if _, err := rwn.Release(tag); err != nil {
+		return err
+	}
+	return os.RemoveAll(rwn.releaseDir(tag))
+}
+
+func validateAssetName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") ||
+		strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid asset name %q", name)
+	}
+	return nil
+}
+
+func (rwn RepositoryWithName) assetPath(tag, name string) string {
+	return filepath.Join(rwn.releaseDir(tag), "assets", name)
+}
+
+// AddReleaseAsset stores the contents of r as an asset of the release,
+// replacing an asset of the same name.
+func (rwn RepositoryWithName) AddReleaseAsset(tag, name string, r io.Reader) (ReleaseAsset, error) {
+	var asset ReleaseAsset
+	if err := validateAssetName(name); err != nil {
+		return asset, err
+	}
+	if _, err := rwn.Release(tag); err != nil {
+		return asset, err
+	}
+	f, err := os.CreateTemp(filepath.Join(rwn.releaseDir(tag), "assets"), ".upload-*")
+	if err != nil {
+		return asset, err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, maxAssetSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return asset, err
+	}
+	if size > maxAssetSize {
+		return asset, fmt.Errorf("asset is larger than %d bytes", maxAssetSize)
+	}
+
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+	// Read again, the release may have changed during the upload.
+	rel, err := rwn.Release(tag)
+	if err != nil {
+		return asset, err
+	}
+	if err := os.Rename(f.Name(), rwn.assetPath(tag, name)); err != nil {
+		return asset, err
+	}
+	asset = ReleaseAsset{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil)), Uploaded: time.Now().UTC()}
+	assets := rel.Assets[:0]
+	for _, a := range rel.Assets {
+		if a.Name != name {
+			assets = append(assets, a)
+		}
+	}
+	rel.Assets = append(assets, asset)
+	sort.Slice(rel.Assets, func(i, j int) bool { return rel.Assets[i].Name < rel.Assets[j].Name })
+	return asset, rwn.writeRelease(rel)
+}
+
+func (rwn RepositoryWithName) RemoveReleaseAsset(tag, name string) error {
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+	rel, err := rwn.Release(tag)
+	if err != nil {
+		return err
+	}
+	if _, ok := rel.Asset(name); !ok {
+		return ErrAssetNotFound
+	}
+	assets := rel.Assets[:0]
+	for _, a := range rel.Assets {
+		if a.Name != name {
+			assets = append(assets, a)
+		}
+	}
+	rel.Assets = assets
+	if err := rwn.writeRelease(rel); err != nil {
+		return err
+	}
+	return os.Remove(rwn.assetPath(tag, name))
+}
+
+// OpenReleaseAsset opens an asset for download.
+func (rwn RepositoryWithName) OpenReleaseAsset(tag, name string) (*os.File, ReleaseAsset, error) {
+	rel, err := rwn.Release(tag)
+	if err != nil {
+		return nil, ReleaseAsset{}, err
+	}
+	asset, ok := rel.Asset(name)
+	if !ok {
+		return nil, asset, ErrAssetNotFound
+	}
+	f, err := os.Open(rwn.assetPath(tag, name))
+	return f, asset, err
+}
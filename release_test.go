@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestValidateTagName(t *testing.T) {
+	for _, tag := range []string{"v1.0.0", "release/2024-01", "v1.0-rc.1", "foo.locked"} {
+		if err := validateTagName(tag); err != nil {
+			t.Errorf("%q: %v", tag, err)
+		}
+	}
+	for _, tag := range []string{
+		"", "@", "..", "x/../../heads/pwn", "/v1", "v1/", "v1//x", "-v1", "v1.",
+		".hidden", "x/.hidden", "v1.lock", "x.lock/y", "v1@{0}", "v 1", "v1~1",
+		"v1^", "v1:x", "v1?", "v1*", "v1[", "v1\\x", "v1\x00", "v1\n", "v1\x7f",
+	} {
+		if err := validateTagName(tag); err == nil {
+			t.Errorf("%q accepted", tag)
+		}
+	}
+}
+
+func TestCreateReleaseRejectsInvalidTags(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, repo, "README", "one\n")
+	rwn := RepositoryWithName{Name: "repo", Path: dir, Repository: repo}
+
+	if _, err := rwn.CreateRelease(Release{Tag: "x/../../heads/pwn"}, "HEAD"); err == nil {
+		t.Fatal("release created")
+	}
+	if _, err := repo.Reference("refs/heads/pwn", false); err == nil {
+		t.Fatal("branch created through the tag")
+	}
+	if _, err := os.Stat(filepath.Join(rwn.GitDir(), "releases")); !os.IsNotExist(err) {
+		t.Fatalf("releases directory written: %v", err)
+	}
+
+	rel, err := rwn.CreateRelease(Release{Tag: "v1.0.0"}, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Reference(plumbing.NewTagReferenceName(rel.Tag), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwn.Release(".."); err != ErrReleaseNotFound {
+		t.Fatalf("release .. = %v", err)
+	}
+}
+
+func TestReleaseAPISignatures(t *testing.T) {
+	sc, url := newProtocolServer(t, GitBackendExec)
+	rwn, _ := sc.FindRepo("repo.git")
+	keys := t.TempDir()
+	key := filepath.Join(keys, "id_ed25519")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Skipf("ssh-keygen: %v: %s", err, out)
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keys, "allowed_signers"), append([]byte("test@example.com "), pub...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sc.Keyring, err = LoadKeyring(keys); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, rwn.Path, "-c", "gpg.format=ssh", "-c", "user.signingkey="+key, "tag", "-s", "-m", "v2", "v2", "master")
+	for _, tag := range []string{"v1", "v2"} {
+		if _, err := rwn.CreateRelease(Release{Tag: tag}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(tag string) (out releaseJSON) {
+		resp, err := http.Get(url + "/api/releases/" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	signed := get("v2")
+	if signed.TagSignature == nil || signed.TagSignature.Status != SignatureVerified {
+		t.Fatalf("v2 tag signature %+v", signed.TagSignature)
+	}
+	if signed.Commit != serverRef(t, sc, "master") || signed.CommitSignature == nil || signed.CommitSignature.Signed() {
+		t.Fatalf("v2 commit %s, signature %+v", signed.Commit, signed.CommitSignature)
+	}
+	if lightweight := get("v1"); lightweight.TagSignature != nil || lightweight.CommitSignature == nil {
+		t.Fatalf("v1 signatures: tag %+v, commit %+v", lightweight.TagSignature, lightweight.CommitSignature)
+	}
+}
@@ -18,9 +18,26 @@ func r(s string) *regexp.Regexp {
 	return reg
 }
 
+// PrefixFunc looks for a known name at the start of path. It returns the
+// value to store as parameter and the rest of the path.
+type PrefixFunc func(path string) (value string, rest string, ok bool)
+
+// Route either handles paths matching pattern, or, when prefix is set,
+// consumes the start of the path and matches the rest against its sub
+// routes.
 type Route struct {
 	pattern *regexp.Regexp
 	handler http.HandlerFunc
+
+	param  string
+	prefix PrefixFunc
+	routes []Route
+}
+
+// Mount returns a route resolving a path prefix with fn, e.g. a repository
+// name that may itself contain slashes, before matching routes.
+func Mount(param string, fn PrefixFunc, routes []Route) Route {
+	return Route{param: param, prefix: fn, routes: routes}
 }
 
 type Router struct {
@@ -35,24 +52,42 @@ func newContextWithParams(ctx context.Context, params map[string]string) context
 	return context.WithValue(ctx, ParamsKey, params)
 }
 
-func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.Method, r.URL.Path)
-	for _, route := range router.routes {
+func match(routes []Route, path string, params map[string]string) http.HandlerFunc {
+	for _, route := range routes {
+		if route.prefix != nil {
+			value, rest, ok := route.prefix(path)
+			if !ok {
+				continue
+			}
+			if handler := match(route.routes, rest, params); handler != nil {
+				params[route.param] = value
+				return handler
+			}
+			continue
+		}
 		re := route.pattern
-		match := re.FindStringSubmatch(r.URL.Path)
-		if len(match) > 0 {
+		m := re.FindStringSubmatch(path)
+		if len(m) > 0 {
 			// Extract parameter values from the URL
-			params := make(map[string]string)
 			for i, name := range re.SubexpNames() {
 				if i != 0 && name != "" {
-					params[name] = match[i]
+					params[name] = m[i]
 				}
 			}
-			// Call the handler with the extracted parameter values
-			route.handler(w, r.WithContext(newContextWithParams(r.Context(), params)))
-			return
+			return route.handler
 		}
 	}
+	return nil
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.URL.Path)
+	params := make(map[string]string)
+	if handler := match(router.routes, r.URL.Path, params); handler != nil {
+		// Call the handler with the extracted parameter values
+		handler(w, r.WithContext(newContextWithParams(r.Context(), params)))
+		return
+	}
 	// No matching route found
 	http.NotFound(w, r)
 }
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	maxIndexedFileSize = 1 << 20
+	maxSearchResults   = 100
+	maxHitsPerFile     = 5
+	searchContextLines = 1
+)
+
+// IndexedFile is one file of the default branch. Trigrams are stored per
+// file so that an update only has to read blobs that actually changed.
+type IndexedFile struct {
+	Path     string
+	Blob     plumbing.Hash
+	Lang     string
+	Trigrams []uint32
+}
+
+// RepoIndex is the trigram index of a single repository. It is persisted as
+// gob in the index directory, the posting lists are rebuilt after loading.
+type RepoIndex struct {
+	Repo   string
+	Ref    string
+	Commit plumbing.Hash
+	Files  []IndexedFile
+
+	repository *git.Repository
+	postings   map[uint32][]int
+}
+
+func (ri *RepoIndex) buildPostings() {
+	ri.postings = make(map[uint32][]int)
+	for i, f := range ri.Files {
+		for _, t := range f.Trigrams {
+			ri.postings[t] = append(ri.postings[t], i)
+		}
+	}
+}
+
+// candidates returns the files containing all trigrams, or every file when
+// no trigrams are given.
+func (ri *RepoIndex) candidates(trigrams []uint32) []int {
+	if len(trigrams) == 0 {
+		all := make([]int, len(ri.Files))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+	var result []int
+	for n, t := range trigrams {
+		list := ri.postings[t]
+		if n == 0 {
+			result = append(result, list...)
+			continue
+		}
+		result = intersect(result, list)
+		if len(result) == 0 {
+			break
+		}
+	}
+	return result
+}
+
+func intersect(a, b []int) []int {
+	var out []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+type SearchIndex struct {
+	Dir string
+	// updating serializes Update so concurrent pushes don't race on the
+	// index files.
+	updating sync.Mutex
+	mu       sync.RWMutex
+	repos    map[string]*RepoIndex
+}
+
+func NewSearchIndex(dir string) *SearchIndex {
+	return &SearchIndex{
+		Dir:   dir,
+		repos: make(map[string]*RepoIndex),
+	}
+}
+
+func (si *SearchIndex) indexPath(name string) string {
+	return filepath.Join(si.Dir, strings.ReplaceAll(name, "/", "%2F")+".gob")
+}
+
+func (si *SearchIndex) load(name string) *RepoIndex {
+	f, err := os.Open(si.indexPath(name))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var ri RepoIndex
+	if err := gob.NewDecoder(f).Decode(&ri); err != nil {
+		log.Printf("search: discarding index of %s: %v", name, err)
+		return nil
+	}
+	return &ri
+}
+
+func (si *SearchIndex) save(ri *RepoIndex) error {
+	if err := os.MkdirAll(si.Dir, 0755); err != nil {
+		return err
+	}
+	// SSH sessions save indexes too, each writer gets its own temporary file.
+	f, err := os.CreateTemp(si.Dir, filepath.Base(si.indexPath(ri.Repo))+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(ri); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), si.indexPath(ri.Repo))
+}
+
+// Update brings the index of repo up to date with its default branch. Only
+// blobs that are not already indexed are read.
+func (si *SearchIndex) Update(repo RepositoryWithName) error {
+	si.updating.Lock()
+	defer si.updating.Unlock()
+
+	si.mu.RLock()
+	prev := si.repos[repo.Name]
+	si.mu.RUnlock()
+
+	ref, revision, err := FindMainBranch(repo.Repository)
+	if err != nil || repo.IsUnlisted() {
+		// Nothing to index in an empty or unlisted repository.
+		si.Remove(repo.Name)
+		return nil
+	}
+	if prev == nil || prev.Commit != *revision || prev.Ref != ref {
+		// A push over SSH saves the index in its own process, the file may
+		// be ahead of memory.
+		if saved := si.load(repo.Name); saved != nil &&
+			(prev == nil || saved.Commit == *revision && saved.Ref == ref) {
+			prev = saved
+		}
+	}
+	if prev != nil && prev.Commit == *revision && prev.Ref == ref {
+		// Searches may be reading prev, the copy is published instead.
+		ri := *prev
+		ri.repository = repo.Repository
+		ri.buildPostings()
+		si.mu.Lock()
+		si.repos[repo.Name] = &ri
+		si.mu.Unlock()
+		return nil
+	}
+
+	known := make(map[plumbing.Hash][]uint32)
+	if prev != nil {
+		for _, f := range prev.Files {
+			known[f.Blob] = f.Trigrams
+		}
+	}
+
+	commit, err := repo.Repository.CommitObject(*revision)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	ri := &RepoIndex{Repo: repo.Name, Ref: ref, Commit: *revision, repository: repo.Repository}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if f.Size > maxIndexedFileSize {
+			return nil
+		}
+		trigrams, ok := known[f.Hash]
+		if !ok {
+			contents, err := blobContents(&f.Blob)
+			if err != nil || isBinary(contents) {
+				return err
+			}
+			trigrams = Trigrams(contents)
+		}
+		ri.Files = append(ri.Files, IndexedFile{
+			Path:     f.Name,
+			Blob:     f.Hash,
+			Lang:     DetectLanguage(f.Name),
+			Trigrams: trigrams,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ri.buildPostings()
+
+	si.mu.Lock()
+	si.repos[repo.Name] = ri
+	si.mu.Unlock()
+	return si.save(ri)
+}
+
+func (si *SearchIndex) Remove(name string) {
+	si.mu.Lock()
+	delete(si.repos, name)
+	si.mu.Unlock()
+	os.Remove(si.indexPath(name))
+}
+
+// Stale reports whether the index of repo doesn't match its main branch,
+// after a push that bypassed the server.
+func (si *SearchIndex) Stale(repo RepositoryWithName) bool {
+	si.mu.RLock()
+	ri := si.repos[repo.Name]
+	si.mu.RUnlock()
+	ref, revision, err := FindMainBranch(repo.Repository)
+	if err != nil || repo.IsUnlisted() {
+		return ri != nil
+	}
+	return ri == nil || ri.Commit != *revision || ri.Ref != ref
+}
+
+// UpdateStale indexes the repositories whose index is stale, logging
+// failures.
+func (si *SearchIndex) UpdateStale(repos []RepositoryWithName) {
+	for _, repo := range repos {
+		if !si.Stale(repo) {
+			continue
+		}
+		if err := si.Update(repo); err != nil {
+			log.Printf("search: indexing %s: %v", repo.Name, err)
+		}
+	}
+}
+
+// UpdateAll indexes every repository, logging failures.
+func (si *SearchIndex) UpdateAll(repos []RepositoryWithName) {
+	for _, repo := range repos {
+		if err := si.Update(repo); err != nil {
+			log.Printf("search: indexing %s: %v", repo.Name, err)
+		}
+	}
+}
+
+func blobContents(b *object.Blob) ([]byte, error) {
+	r, err := b.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func isBinary(contents []byte) bool {
+	head := contents
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	return bytes.IndexByte(head, 0) >= 0
+}
+
+func DetectLanguage(name string) string {
+	lexer := lexers.Match(path.Base(name))
+	if lexer == nil {
+		return ""
+	}
+	return lexer.Config().Name
+}
+
+// Trigrams returns the sorted, de-duplicated case-folded trigrams of s.
+func Trigrams(contents []byte) []uint32 {
+	lower := bytes.ToLower(contents)
+	seen := make(map[uint32]struct{})
+	for i := 0; i+3 <= len(lower); i++ {
+		seen[uint32(lower[i])<<16|uint32(lower[i+1])<<8|uint32(lower[i+2])] = struct{}{}
+	}
+	out := make([]uint32, 0, len(seen))
+	for t := range seen {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// requiredLiterals returns literal strings every match of re must contain.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var out []string
+		var run strings.Builder
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral {
+				run.WriteString(string(sub.Rune))
+				continue
+			}
+			if run.Len() > 0 {
+				out = append(out, run.String())
+				run.Reset()
+			}
+			out = append(out, requiredLiterals(sub)...)
+		}
+		if run.Len() > 0 {
+			out = append(out, run.String())
+		}
+		return out
+	}
+	return nil
+}
+
+type SearchQuery struct {
+	Text  string
+	Regex bool
+	Repo  string
+	Path  string
+	Lang  string
+	// Limit caps the results, maxSearchResults when zero.
+	Limit int
+}
+
+// ParseSearchQuery splits repo:, path: and lang: filters from the query.
+func ParseSearchQuery(q string) SearchQuery {
+	var query SearchQuery
+	var terms []string
+	for _, field := range strings.Fields(q) {
+		key, value, ok := strings.Cut(field, ":")
+		switch {
+		case ok && key == "repo":
+			query.Repo = value
+		case ok && key == "path":
+			query.Path = value
+		case ok && key == "lang":
+			query.Lang = value
+		default:
+			terms = append(terms, field)
+		}
+	}
+	query.Text = strings.Join(terms, " ")
+	return query
+}
+
+type SearchSegment struct {
+	Text  string
+	Match bool
+}
+
+type SearchLine struct {
+	Number   int
+	Segments []SearchSegment
+}
+
+type SearchResult struct {
+	Repo  string
+	Ref   string
+	Path  string
+	Lang  string
+	Lines [][]SearchLine
+}
+
+func (si *SearchIndex) Search(query SearchQuery) ([]SearchResult, error) {
+	if query.Text == "" {
+		return nil, errors.New("empty query")
+	}
+	pattern := query.Text
+	if !query.Regex {
+		pattern = "(?i)" + regexp.QuoteMeta(pattern)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = maxSearchResults
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	var trigrams []uint32
+	for _, lit := range requiredLiterals(parsed.Simplify()) {
+		trigrams = append(trigrams, Trigrams([]byte(lit))...)
+	}
+
+	si.mu.RLock()
+	var indexes []*RepoIndex
+	for name, ri := range si.repos {
+		if query.Repo == "" || name == query.Repo {
+			indexes = append(indexes, ri)
+		}
+	}
+	si.mu.RUnlock()
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Repo < indexes[j].Repo })
+
+	var results []SearchResult
+	for _, ri := range indexes {
+		for _, i := range ri.candidates(trigrams) {
+			f := ri.Files[i]
+			if query.Path != "" && !strings.Contains(f.Path, query.Path) {
+				continue
+			}
+			if query.Lang != "" && !strings.EqualFold(f.Lang, query.Lang) {
+				continue
+			}
+			blob, err := ri.repository.BlobObject(f.Blob)
+			if err != nil {
+				continue
+			}
+			contents, err := blobContents(blob)
+			if err != nil {
+				continue
+			}
+			hits := matchLines(re, string(contents))
+			if len(hits) == 0 {
+				continue
+			}
+			results = append(results, SearchResult{
+				Repo:  ri.Repo,
+				Ref:   ri.Ref,
+				Path:  f.Path,
+				Lang:  f.Lang,
+				Lines: hits,
+			})
+			if len(results) >= limit {
+				return results, nil
+			}
+		}
+	}
+	return results, nil
+}
+
+// matchLines returns up to maxHitsPerFile matching lines, each with the
+// surrounding context lines.
+func matchLines(re *regexp.Regexp, contents string) [][]SearchLine {
+	lines := strings.Split(contents, "\n")
+	var hits [][]SearchLine
+	for n, line := range lines {
+		matches := re.FindAllStringIndex(line, -1)
+		if matches == nil {
+			continue
+		}
+		var hit []SearchLine
+		for c := n - searchContextLines; c <= n+searchContextLines; c++ {
+			if c < 0 || c >= len(lines) {
+				continue
+			}
+			sl := SearchLine{Number: c + 1}
+			if c == n {
+				sl.Segments = highlight(line, matches)
+			} else {
+				sl.Segments = []SearchSegment{{Text: lines[c]}}
+			}
+			hit = append(hit, sl)
+		}
+		hits = append(hits, hit)
+		if len(hits) >= maxHitsPerFile {
+			break
+		}
+	}
+	return hits
+}
+
+func highlight(line string, matches [][]int) []SearchSegment {
+	var segments []SearchSegment
+	last := 0
+	for _, m := range matches {
+		if m[0] > last {
+			segments = append(segments, SearchSegment{Text: line[last:m[0]]})
+		}
+		if m[1] > m[0] {
+			segments = append(segments, SearchSegment{Text: line[m[0]:m[1]], Match: true})
+		}
+		last = m[1]
+	}
+	if last < len(line) {
+		segments = append(segments, SearchSegment{Text: line[last:]})
+	}
+	return segments
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// TestSearchDuringUpdate is meant for go test -race. Updates of an index
+// that is still current, like pushes changing nothing, run while searches
+// read it.
+func TestSearchDuringUpdate(t *testing.T) {
+	sc := newTestSmithy(t)
+	path := filepath.Join(sc.Root, "repo")
+	repo, err := git.PlainInit(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, repo, "README", "hello search\n")
+	rwn := RepositoryWithName{Name: "repo", Path: path, Repository: repo}
+	if err := sc.Search.Update(rwn); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := sc.Search.Update(rwn); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			results, err := sc.Search.Search(SearchQuery{Text: "hello"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(results) != 1 {
+				t.Errorf("%d results, want 1", len(results))
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
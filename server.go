@@ -1,24 +1,32 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 var (
-	offset        = 5
-	PAGE_SIZE int = 500
+	offset = 5
 )
 
 //go:embed templates
@@ -31,9 +39,19 @@ type GitCommand struct {
 
 type H = map[string]interface{}
 
+// LoadTemplates parses the embedded templates, files of the templates
+// directory replace the embedded ones of the same name.
 func (sc *Smithy) LoadTemplates() error {
-	t := template.New("")
-	files, err := templatefiles.ReadDir("templates")
+	t := template.New("").Funcs(template.FuncMap{
+		"mirror":     sc.MirrorStatus,
+		"static":     func(name string) string { return sc.Static().URL(name) },
+		"site":       func() SiteConfig { return sc.Config().Site },
+		"features":   func() Features { return sc.Config().Features },
+		"repoConfig": func(repo string) RepoConfig { return sc.Config().For(repo) },
+		"cloneURL":   func(protocol, repo string) string { return sc.Config().CloneURL(protocol, repo) },
+	})
+	fsys := themeFS(templatefiles, "templates", sc.Config().Templates)
+	files, err := fs.ReadDir(fsys, ".")
 	if err != nil {
 		return err
 	}
@@ -41,11 +59,7 @@ func (sc *Smithy) LoadTemplates() error {
 		if !strings.HasSuffix(file.Name(), ".html") {
 			continue
 		}
-		f, err := templatefiles.Open("templates/" + file.Name())
-		if err != nil {
-			return err
-		}
-		contents, err := io.ReadAll(f)
+		contents, err := fs.ReadFile(fsys, file.Name())
 		if err != nil {
 			return err
 		}
@@ -55,7 +69,7 @@ func (sc *Smithy) LoadTemplates() error {
 			return err
 		}
 	}
-	sc.template = t
+	sc.template.Store(t)
 	return nil
 }
 
@@ -64,71 +78,321 @@ func (sc *Smithy) GetParam(r *http.Request, name string) (out string) {
 }
 
 func (sc *Smithy) Render(w http.ResponseWriter, name string, data H) {
+	sc.RenderStatus(w, http.StatusOK, name, data)
+}
+
+// RenderStatus renders the page into a buffer first, a template failing
+// halfway gets an error instead of half a page. In dev mode the theme is
+// reloaded for every page and errors are shown in full.
+func (sc *Smithy) RenderStatus(w http.ResponseWriter, code int, name string, data H) {
+	dev := sc.Config().Dev
+	if dev {
+		if err := sc.LoadTheme(); err != nil {
+			log.Printf("theme: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if err := sc.template.Load().ExecuteTemplate(&buf, name+".html", data); err != nil {
+		log.Printf("template %s: %v", name, err)
+		message := "Template error"
+		if dev {
+			message = err.Error()
+		}
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	sc.template.ExecuteTemplate(w, name+".html", data)
+	w.WriteHeader(code)
+	buf.WriteTo(w)
 }
 
 func (sc *Smithy) Error(w http.ResponseWriter, code int, err error) {
-	w.WriteHeader(code)
-	sc.Render(w, "error", H{
+	sc.RenderStatus(w, code, "error", H{
 		"Error": err.Error(),
 	})
 }
 
+// authorizeAdmin checks the bearer token of admin requests. Admin endpoints
+// are disabled unless a token is configured. Browsers can't send a bearer
+// token from a form, they log in with the token as Basic password.
+func (sc *Smithy) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if sc.Config().AdminToken == "" {
+		http.Error(w, "Admin endpoints are disabled", http.StatusForbidden)
+		return false
+	}
+	if !sc.checkAdmin(r) {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="smithy"`)
+		w.Header().Add("WWW-Authenticate", `Basic realm="smithy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// checkAdmin reports whether r carries the admin token, for handlers
+// answering in their own format.
+func (sc *Smithy) checkAdmin(r *http.Request) bool {
+	adminToken := sc.Config().AdminToken
+	if adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// repoAccess guards the routes of a repository, private repositories need
+// the admin token. Git clients ask for it as password when they get the
+// challenge.
+func (sc *Smithy) repoAccess(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repo, exists := sc.FindRepo(sc.GetParam(r, "repo"))
+		if exists && repo.IsPrivate() && !sc.authorizeAdmin(w, r) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Reload forces a rescan of Root, for when filesystem events were missed.
 func (sc *Smithy) Reload(w http.ResponseWriter, r *http.Request) {
-	sc.LoadAllRepositories()
-	fmt.Fprintf(w, "done")
+	if r.Method != http.MethodPost {
+		http.Error(w, "Use POST to rescan", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sc.authorizeAdmin(w, r) {
+		return
+	}
+	result, err := sc.Rescan()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "added: %s\nremoved: %s\n", strings.Join(result.Added, " "), strings.Join(result.Removed, " "))
+}
+
+func (sc *Smithy) SearchView(w http.ResponseWriter, r *http.Request) {
+	if !sc.Config().Features.SearchEnabled() {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Search is disabled"))
+		return
+	}
+	q := r.URL.Query().Get("q")
+	query := ParseSearchQuery(q)
+	query.Regex = r.URL.Query().Get("regex") == "on"
+	query.Limit = sc.Config().PageSize.Search
+	if repo := r.URL.Query().Get("repo"); repo != "" {
+		query.Repo = repo
+	}
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		query.Lang = lang
+	}
+	if p := r.URL.Query().Get("path"); p != "" {
+		query.Path = p
+	}
+
+	data := H{
+		"Query": q,
+		"Regex": query.Regex,
+	}
+	code := http.StatusOK
+	if query.Text != "" {
+		results, err := sc.Search.Search(query)
+		if err != nil {
+			code = http.StatusBadRequest
+			data["Error"] = err.Error()
+		}
+		data["Results"] = results
+	}
+	sc.RenderStatus(w, code, "search", data)
 }
 
 func (sc *Smithy) IndexView(w http.ResponseWriter, r *http.Request) {
-	repos := sc.GetRepositories()
-	// commits, _ := repo.CommitObjects()
-	// lastCommit, _ := commits.Next()
+	group := sc.GetParam(r, "group")
+	groups, repos, exists := sc.GetGroup(group)
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Group not found"))
+		return
+	}
+
+	var infos []RepositoryInfo
+	for _, repo := range repos {
+		infos = append(infos, RepositoryInfo{repo, sc.Metadata(repo)})
+	}
+	sortBy := r.URL.Query().Get("sort")
+	switch sortBy {
+	case "description":
+		sort.SliceStable(infos, func(i, j int) bool { return infos[i].Description < infos[j].Description })
+	case "owner":
+		sort.SliceStable(infos, func(i, j int) bool { return infos[i].Owner < infos[j].Owner })
+	case "activity":
+		sort.SliceStable(infos, func(i, j int) bool { return infos[i].LastActivity.After(infos[j].LastActivity) })
+	default:
+		sortBy = "name"
+	}
+
 	sc.Render(w, "index", H{
-		"Repos": repos,
+		"Group":  group,
+		"Groups": groups,
+		"Repos":  infos,
+		"Sort":   sortBy,
 	})
 }
 
 func (sc *Smithy) NewProject(w http.ResponseWriter, r *http.Request) {
+	if !sc.Config().Features.CreateEnabled() {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Creating repositories is disabled"))
+		return
+	}
 	if r.Method == http.MethodGet {
-		sc.Render(w, "new", H{})
+		sc.Render(w, "new", H{
+			"Gitignores": ListInitTemplates("gitignore"),
+			"Licenses":   ListInitTemplates("license"),
+		})
 		return
 	}
 	r.ParseForm()
-	repoName := r.FormValue("name")
-	repoPath := filepath.Join(sc.Root, repoName)
-	_, err := git.PlainInit(repoPath, true)
+	opts := ProjectOptions{
+		Name:        strings.Trim(strings.TrimSpace(r.FormValue("name")), "/"),
+		Description: r.FormValue("description"),
+		Owner:       strings.TrimSpace(r.FormValue("owner")),
+		Readme:      r.FormValue("readme") == "on",
+		Gitignore:   r.FormValue("gitignore"),
+		License:     r.FormValue("license"),
+	}
+	repo, err := sc.CreateRepository(opts)
+	if errors.Is(err, ErrRepositoryExists) {
+		sc.Error(w, http.StatusConflict, err)
+		return
+	}
 	if err != nil {
-		sc.Error(w, http.StatusInternalServerError, err)
+		sc.Error(w, http.StatusBadRequest, err)
+		return
 	}
-	fmt.Fprint(w, repoName)
+	http.Redirect(w, r, "/"+repo.Name, http.StatusSeeOther)
 }
 
 func (sc *Smithy) ImportProject(w http.ResponseWriter, r *http.Request) {
+	if !sc.Config().Features.ImportEnabled() {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Importing repositories is disabled"))
+		return
+	}
 	if r.Method == http.MethodGet {
 		sc.Render(w, "import", H{})
 		return
 	}
 	r.ParseForm()
-	name := r.FormValue("name")
-	bare := r.FormValue("bare")
-	address := r.FormValue("git")
-	repoPath := filepath.Join(sc.Root, name)
-	isBare := bare == "on"
-	repo, err := git.PlainClone(repoPath, isBare, &git.CloneOptions{
-		URL: address,
-	})
+	var interval time.Duration
+	if v := strings.TrimSpace(r.FormValue("interval")); v != "" {
+		var err error
+		if interval, err = time.ParseDuration(v); err != nil {
+			sc.Error(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	opts := ImportOptions{
+		Name:   strings.Trim(strings.TrimSpace(r.FormValue("name")), "/"),
+		URL:    strings.TrimSpace(r.FormValue("git")),
+		Bare:   r.FormValue("bare") == "on",
+		Mirror: r.FormValue("mirror") == "on",
+		Credentials: Credentials{
+			Username:      r.FormValue("username"),
+			Password:      r.FormValue("password"),
+			SSHKey:        r.FormValue("ssh_key"),
+			SSHPassphrase: r.FormValue("ssh_passphrase"),
+		},
+		SyncInterval: interval,
+	}
+	if opts.Mirror && !sc.Config().For(opts.Name).Features.MirrorsEnabled() {
+		sc.Error(w, http.StatusForbidden, fmt.Errorf("Mirrors are disabled"))
+		return
+	}
+	job, err := sc.StartImport(opts)
+	if errors.Is(err, ErrRepositoryExists) {
+		sc.Error(w, http.StatusConflict, err)
+		return
+	}
 	if err != nil {
-		sc.Error(w, http.StatusInternalServerError, err)
+		sc.Error(w, http.StatusBadRequest, err)
+		return
+	}
+	http.Redirect(w, r, "/import/"+job.ID, http.StatusSeeOther)
+}
+
+func (sc *Smithy) ImportStatusView(w http.ResponseWriter, r *http.Request) {
+	if !sc.Config().Features.ImportEnabled() {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Importing repositories is disabled"))
+		return
+	}
+	job, exists := sc.imports.Get(sc.GetParam(r, "job"))
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Import not found"))
+		return
+	}
+	sc.Render(w, "importstatus", H{
+		"Job": job,
+	})
+}
+
+// ImportProgressView streams the progress of an import as plain text until
+// it finishes.
+func (sc *Smithy) ImportProgressView(w http.ResponseWriter, r *http.Request) {
+	if !sc.Config().Features.ImportEnabled() {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Importing repositories is disabled"))
+		return
+	}
+	job, exists := sc.imports.Get(sc.GetParam(r, "job"))
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	sent := 0
+	for {
+		running := job.Running()
+		progress := job.Progress()
+		if len(progress) < sent {
+			// The buffer was trimmed, start over from what's left.
+			sent = 0
+		}
+		io.WriteString(w, progress[sent:])
+		sent = len(progress)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !running {
+			fmt.Fprintf(w, "\n%s %s\n", job.Status(), job.ErrorMessage())
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func (sc *Smithy) ImportCancel(w http.ResponseWriter, r *http.Request) {
+	if !sc.Config().Features.ImportEnabled() {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Importing repositories is disabled"))
+		return
+	}
+	job, exists := sc.imports.Get(sc.GetParam(r, "job"))
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Import not found"))
 		return
 	}
-	rwn := RepositoryWithName{
-		Name:       name,
-		Repository: repo,
-		Path:       repoPath,
+	if r.Method != http.MethodPost {
+		sc.Error(w, http.StatusMethodNotAllowed, fmt.Errorf("Use POST to cancel an import"))
+		return
 	}
-	sc.AddRepository(rwn)
-	sc.Reload(w, r)
+	job.Cancel()
+	http.Redirect(w, r, "/import/"+job.ID, http.StatusSeeOther)
 }
 
 func (sc *Smithy) RepoView(w http.ResponseWriter, r *http.Request) {
@@ -151,12 +415,15 @@ func (sc *Smithy) RepoView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	main, revision, err := FindMainBranch(repo.Repository)
+	_, revision, err := sc.MainBranch(repo)
+	if errors.Is(err, ErrEmptyRepository) {
+		sc.Render(w, "empty", H{"RepoName": repoName})
+		return
+	}
 	if err != nil {
 		sc.Error(w, http.StatusInternalServerError, err)
 		return
 	}
-	log.Printf(`%s default branch is "%s"`, repoName, main)
 	commitObj, err := repo.Repository.CommitObject(*revision)
 	if err != nil {
 		sc.Error(w, http.StatusInternalServerError, err)
@@ -182,31 +449,263 @@ func (sc *Smithy) RepoView(w http.ResponseWriter, r *http.Request) {
 		"Tags":     tags,
 		"Readme":   template.HTML(formattedReadme),
 		"Repo":     repo,
+		"Forks":    sc.listedForks(repo),
 	})
 }
 
-func (sc *Smithy) RefsView(w http.ResponseWriter, r *http.Request) {
+func (sc *Smithy) SettingsView(w http.ResponseWriter, r *http.Request) {
 	repoName := sc.GetParam(r, "repo")
 	repo, exists := sc.FindRepo(repoName)
 	if !exists {
 		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
 		return
 	}
+	// Settings can delete the repository, only admins see them at all.
+	if !sc.authorizeAdmin(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		var err error
+		action := r.FormValue("action")
+		switch action {
+		case "mirror", "sync", "push-mirror-add", "push-mirror-remove", "push-now":
+			if !sc.Config().For(repo.Name).Features.MirrorsEnabled() {
+				sc.Error(w, http.StatusForbidden, fmt.Errorf("Mirrors are disabled"))
+				return
+			}
+		}
+		switch action {
+		case "description":
+			err = repo.WriteDescription(r.FormValue("description"))
+		case "default-branch":
+			err = repo.SetDefaultBranch(r.FormValue("branch"))
+			if err == nil {
+				go sc.Search.Update(repo)
+			}
+		case "archive":
+			err = repo.SetArchived(r.FormValue("archived") == "on")
+		case "mirror":
+			interval := defaultMirrorInterval
+			if v := strings.TrimSpace(r.FormValue("interval")); v != "" {
+				interval, err = time.ParseDuration(v)
+			}
+			if err == nil {
+				err = repo.SetMirror(strings.TrimSpace(r.FormValue("url")), interval)
+			}
+		case "sync":
+			// Failures are recorded in the mirror status shown on the page.
+			if !repo.IsMirror() {
+				err = fmt.Errorf("%s is not a mirror", repo.Name)
+			} else if err := sc.SyncMirror(repo); err != nil {
+				log.Printf("mirror: syncing %s: %v", repo.Name, err)
+			}
+		case "push-mirror-add":
+			err = repo.AddPushMirror(strings.TrimSpace(r.FormValue("name")), strings.TrimSpace(r.FormValue("url")))
+		case "push-mirror-remove":
+			err = repo.RemovePushMirror(r.FormValue("name"))
+		case "push-now":
+			sc.QueuePush(repo, nil)
+		case "visibility":
+			err = repo.SetVisibility(r.FormValue("visibility"))
+			if err == nil {
+				go sc.Search.Update(repo)
+			}
+		case "rename":
+			repo, err = sc.RenameRepository(repo.Name, r.FormValue("name"))
+			if err != nil {
+				sc.Error(w, http.StatusBadRequest, err)
+				return
+			}
+		case "delete":
+			if r.FormValue("confirm") != repo.Name {
+				sc.Error(w, http.StatusBadRequest, fmt.Errorf("Type %s to confirm deletion", repo.Name))
+				return
+			}
+			if err := sc.DeleteRepository(repo.Name); err != nil {
+				sc.Error(w, http.StatusInternalServerError, err)
+				return
+			}
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		default:
+			err = fmt.Errorf("Unknown action %q", r.FormValue("action"))
+		}
+		if err != nil {
+			sc.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/%s/settings", repo.Name), http.StatusSeeOther)
+		return
+	}
 
 	branches, err := ListBranches(repo.Repository)
 	if err != nil {
-		branches = []*plumbing.Reference{}
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
 	}
+	defaultBranch, _, _ := sc.MainBranch(repo)
 
-	tags, err := ListTags(repo.Repository)
+	sc.Render(w, "settings", H{
+		"RepoName":      repoName,
+		"Repo":          repo,
+		"Metadata":      sc.Metadata(repo),
+		"Mirror":        sc.MirrorStatus(repo.Name),
+		"PushMirrors":   sc.pushes.Status(repo),
+		"Branches":      branches,
+		"DefaultBranch": defaultBranch,
+	})
+}
+
+func (sc *Smithy) ForkView(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
+		return
+	}
+	if !sc.Config().For(repo.Name).Features.ForkEnabled() {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Forking is disabled"))
+		return
+	}
+	if r.Method == http.MethodGet {
+		sc.Render(w, "fork", H{
+			"RepoName": repoName,
+			"Repo":     repo,
+		})
+		return
+	}
+	r.ParseForm()
+	fork, err := sc.ForkRepository(repo, strings.Trim(strings.TrimSpace(r.FormValue("name")), "/"))
+	if errors.Is(err, ErrRepositoryExists) {
+		sc.Error(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		sc.Error(w, http.StatusBadRequest, err)
+		return
+	}
+	http.Redirect(w, r, "/"+fork.Name, http.StatusSeeOther)
+}
+
+func (sc *Smithy) CompareView(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
+		return
+	}
+	spec := sc.GetParam(r, "spec")
+	if spec == "" {
+		// Without a spec compare the default branch with the parent's.
+		parent, exists := sc.FindRepo(repo.ForkOf())
+		if !exists {
+			sc.Error(w, http.StatusNotFound, fmt.Errorf("Use /%s/compare/base...head", repo.Name))
+			return
+		}
+		parentBranch, _, _ := sc.MainBranch(parent)
+		branch, _, _ := sc.MainBranch(repo)
+		spec = parent.Name + ":" + parentBranch + "..." + branch
+	}
+	baseSpec, headSpec, ok := strings.Cut(spec, "...")
+	if !ok {
+		sc.Error(w, http.StatusBadRequest, fmt.Errorf("Compare %q is not base...head", spec))
+		return
+	}
+	base, err := sc.ParseCompareSide(repo, baseSpec)
+	if err != nil {
+		sc.Error(w, http.StatusNotFound, err)
+		return
+	}
+	head, err := sc.ParseCompareSide(repo, headSpec)
+	if err != nil {
+		sc.Error(w, http.StatusNotFound, err)
+		return
+	}
+	// The routes only checked the repository being viewed.
+	for _, side := range []CompareSide{base, head} {
+		if side.Repo.IsPrivate() && !repo.IsPrivate() && !sc.authorizeAdmin(w, r) {
+			return
+		}
+	}
+	comparison, err := Compare(base, head, sc.Config().For(repo.Name).PageSize.Compare)
+	if errors.Is(err, ErrSiblingForks) {
+		sc.Error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	formattedChanges, err := FormatChanges(comparison.Changes)
+	if err != nil {
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	var commits []Commit
+	for _, commit := range comparison.Commits {
+		commits = append(commits, sc.NewCommit(commit, nil))
+	}
+
+	sc.Render(w, "compare", H{
+		"RepoName":   repoName,
+		"Comparison": comparison,
+		"Commits":    commits,
+		"Changes":    template.HTML(formattedChanges),
+	})
+}
+
+func (sc *Smithy) RefsView(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
+		return
+	}
+
+	branches, err := ListBranchDetails(repo.Repository)
 	if err != nil {
-		tags = []*plumbing.Reference{}
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, b := range branches {
+		b.Signature = sc.Keyring.VerifyCommit(b.Commit)
+	}
+
+	tags, err := ListTagDetails(repo.Repository)
+	if err != nil {
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, t := range tags {
+		if t.Object != nil {
+			t.Signature = sc.Keyring.VerifyTag(t.Object)
+		} else if t.Commit != nil {
+			t.Signature = sc.Keyring.VerifyCommit(t.Commit)
+		}
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "semver" {
+		sort.Stable(TagsBySemver(tags))
+	} else {
+		sortBy = "date"
+		sort.Stable(TagsByDate(tags))
+	}
+
+	released := make(map[string]bool)
+	releases, _ := repo.Releases()
+	for _, rel := range releases {
+		released[rel.Tag] = true
 	}
 
 	sc.Render(w, "refs", map[string]any{
 		"RepoName": repoName,
 		"Branches": branches,
 		"Tags":     tags,
+		"Released": released,
+		"Sort":     sortBy,
 	})
 }
 
@@ -219,22 +718,31 @@ func (sc *Smithy) TreeView(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var err error
-	refName := sc.GetParam(r, "ref")
-	if refName == "" {
-		refName, _, err = FindMainBranch(repo.Repository)
+	var refName, treePath string
+	if rest := sc.GetParam(r, "rest"); rest != "" {
+		refName, treePath, err = SplitRefPath(repo.Repository, rest)
+		if err != nil {
+			sc.Error(w, http.StatusNotFound, err)
+			return
+		}
+	} else {
+		refName, _, err = sc.MainBranch(repo)
+		if errors.Is(err, ErrEmptyRepository) {
+			sc.Render(w, "empty", H{"RepoName": repoName})
+			return
+		}
 		if err != nil {
 			sc.Error(w, http.StatusInternalServerError, err)
 			return
 		}
 	}
 
-	revision, err := repo.Repository.ResolveRevision(plumbing.Revision(refName))
+	revision, err := ResolveRevision(repo.Repository, refName)
 	if err != nil {
-		sc.Error(w, http.StatusInternalServerError, err)
+		sc.Error(w, http.StatusNotFound, err)
 		return
 	}
 
-	treePath := sc.GetParam(r, "path")
 	parentPath := filepath.Dir(treePath)
 	commitObj, err := repo.Repository.CommitObject(*revision)
 	if err != nil {
@@ -293,6 +801,10 @@ func (sc *Smithy) TreeView(w http.ResponseWriter, r *http.Request) {
 		sc.Error(w, http.StatusInternalServerError, err)
 		return
 	}
+	var lfs *LFSFile
+	if pointer, ok := ParseLFSPointer(contents); ok {
+		lfs = repo.lfsFile(pointer)
+	}
 	sc.Render(w, "blob", H{
 		"RepoName":   repoName,
 		"RefName":    refName,
@@ -300,6 +812,7 @@ func (sc *Smithy) TreeView(w http.ResponseWriter, r *http.Request) {
 		"ParentPath": parentPath,
 		"Path":       treePath,
 		"Contents":   contents,
+		"LFS":        lfs,
 	})
 }
 
@@ -313,7 +826,11 @@ func (sc *Smithy) LogView(w http.ResponseWriter, r *http.Request) {
 
 	refName := sc.GetParam(r, "ref")
 	if refName == "" {
-		defaultBranchName, _, err := FindMainBranch(repo.Repository)
+		defaultBranchName, _, err := sc.MainBranch(repo)
+		if errors.Is(err, ErrEmptyRepository) {
+			sc.Render(w, "empty", H{"RepoName": repoName})
+			return
+		}
 		if err != nil {
 			sc.Error(w, http.StatusInternalServerError, err)
 			return
@@ -322,7 +839,13 @@ func (sc *Smithy) LogView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	revision, err := repo.Repository.ResolveRevision(plumbing.Revision(refName))
+	revision, err := ResolveRevision(repo.Repository, refName)
+	if err != nil {
+		sc.Error(w, http.StatusNotFound, err)
+		return
+	}
+
+	decorations, err := Decorations(repo.Repository)
 	if err != nil {
 		sc.Error(w, http.StatusInternalServerError, err)
 		return
@@ -335,25 +858,86 @@ func (sc *Smithy) LogView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for i := 1; i <= PAGE_SIZE; i++ {
+	defer cIter.Close()
+
+	pageSize := sc.Config().For(repo.Name).PageSize.Log
+	for i := 1; i <= pageSize; i++ {
 		commit, err := cIter.Next()
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			sc.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		commits = append(commits, sc.NewCommit(commit, decorations))
+	}
 
-		lines := strings.Split(commit.Message, "\n")
+	sc.Render(w, "log", H{
+		"RepoName": repoName,
+		"RefName":  refName,
+		"Commits":  commits,
+	})
+}
 
-		c := Commit{
-			Commit:    commit,
-			Subject:   lines[0],
-			ShortHash: commit.Hash.String()[:8],
+func (sc *Smithy) CommitSearchView(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
+		return
+	}
+	if !sc.Config().For(repo.Name).Features.SearchEnabled() {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Search is disabled"))
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	query, err := ParseCommitQuery(q)
+	if err != nil {
+		sc.Error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	refName := r.URL.Query().Get("ref")
+	if refName == "" {
+		refName, _, err = sc.MainBranch(repo)
+		if errors.Is(err, ErrEmptyRepository) {
+			sc.Render(w, "empty", H{"RepoName": repoName})
+			return
 		}
-		commits = append(commits, c)
+		if err != nil {
+			sc.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	revision, err := ResolveRevision(repo.Repository, refName)
+	if err != nil {
+		sc.Error(w, http.StatusNotFound, err)
+		return
+	}
+
+	decorations, err := Decorations(repo.Repository)
+	if err != nil {
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	found, err := SearchCommits(repo.Repository, *revision, query, sc.Config().For(repo.Name).PageSize.Log)
+	if err != nil {
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	var commits []Commit
+	for _, commit := range found {
+		commits = append(commits, sc.NewCommit(commit, decorations))
 	}
 
 	sc.Render(w, "log", H{
 		"RepoName": repoName,
 		"RefName":  refName,
+		"Query":    q,
 		"Commits":  commits,
 	})
 }
@@ -371,8 +955,12 @@ func (sc *Smithy) CommitView(w http.ResponseWriter, r *http.Request) {
 		sc.Error(w, http.StatusNotFound, fmt.Errorf("Commit not found"))
 		return
 	}
-	commitHash := plumbing.NewHash(commitID)
-	commitObj, err := repo.Repository.CommitObject(commitHash)
+	revision, err := ResolveRevision(repo.Repository, commitID)
+	if err != nil {
+		sc.Error(w, http.StatusNotFound, err)
+		return
+	}
+	commitObj, err := repo.Repository.CommitObject(*revision)
 	if err != nil {
 		sc.Error(w, http.StatusInternalServerError, err)
 		return
@@ -391,9 +979,10 @@ func (sc *Smithy) CommitView(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sc.Render(w, "commit", H{
-		"RepoName": repoName,
-		"Commit":   commitObj,
-		"Changes":  template.HTML(formattedChanges),
+		"RepoName":  repoName,
+		"Commit":    commitObj,
+		"Signature": sc.Keyring.VerifyCommit(commitObj),
+		"Changes":   template.HTML(formattedChanges),
 	})
 }
 
@@ -411,8 +1000,12 @@ func (sc *Smithy) PatchView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	commitHash := plumbing.NewHash(commitID)
-	commitObj, err := repo.Repository.CommitObject(commitHash)
+	revision, err := ResolveRevision(repo.Repository, commitID)
+	if err != nil {
+		sc.Error(w, http.StatusNotFound, err)
+		return
+	}
+	commitObj, err := repo.Repository.CommitObject(*revision)
 	if err != nil {
 		sc.Error(w, http.StatusInternalServerError, err)
 		return
@@ -452,6 +1045,492 @@ func (sc *Smithy) PatchView(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s\n%s\n%s\n%s\n---\n%s\n%s", commitHashStr, from, date, subject, stats.String(), patch)
 }
 
+// releaseError maps release errors to their status codes.
+func releaseError(err error) int {
+	switch {
+	case errors.Is(err, ErrReleaseNotFound), errors.Is(err, ErrAssetNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrReleaseExists):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// checkReleaseWrite refuses changes to archived repositories, and new tags
+// in mirrors as the next sync would remove them.
+func checkReleaseWrite(repo RepositoryWithName, target string) error {
+	if repo.IsArchived() {
+		return fmt.Errorf("Repository is archived")
+	}
+	if target != "" && repo.IsMirror() {
+		return fmt.Errorf("Repository is a mirror, release an existing tag")
+	}
+	return nil
+}
+
+// createRelease creates the release and replicates a new tag to the push
+// mirrors.
+func (sc *Smithy) createRelease(repo RepositoryWithName, rel Release, target string) (*Release, error) {
+	if err := checkReleaseWrite(repo, target); err != nil {
+		return nil, err
+	}
+	before := RefSnapshot(repo.Repository)
+	created, err := repo.CreateRelease(rel, target)
+	if err != nil {
+		return nil, err
+	}
+	if changed := ChangedRefs(before, RefSnapshot(repo.Repository)); len(changed) > 0 {
+		sc.QueuePush(repo, changed)
+	}
+	return created, nil
+}
+
+func (sc *Smithy) ReleasesView(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if !sc.authorizeAdmin(w, r) {
+			return
+		}
+		r.ParseForm()
+		rel, err := sc.createRelease(repo, Release{
+			Tag:        strings.TrimSpace(r.FormValue("tag")),
+			Title:      strings.TrimSpace(r.FormValue("title")),
+			Notes:      r.FormValue("notes"),
+			Prerelease: r.FormValue("prerelease") == "on",
+		}, strings.TrimSpace(r.FormValue("target")))
+		if err != nil {
+			sc.Error(w, releaseError(err), err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/%s/releases/tag/%s", repoName, rel.Tag), http.StatusSeeOther)
+		return
+	}
+
+	releases, err := repo.Releases()
+	if err != nil {
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	tags, err := ListTags(repo.Repository)
+	if err != nil {
+		sc.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	released := make(map[string]bool)
+	for _, rel := range releases {
+		released[rel.Tag] = true
+	}
+	var unreleased []string
+	for _, tag := range tags {
+		if !released[tag.Name().Short()] {
+			unreleased = append(unreleased, tag.Name().Short())
+		}
+	}
+	var latest string
+	if rel := repo.LatestRelease(); rel != nil {
+		latest = rel.Tag
+	}
+
+	sc.Render(w, "releases", H{
+		"RepoName":   repoName,
+		"Repo":       repo,
+		"Releases":   releases,
+		"Latest":     latest,
+		"Unreleased": unreleased,
+	})
+}
+
+func (sc *Smithy) ReleaseLatest(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
+		return
+	}
+	rel := repo.LatestRelease()
+	if rel == nil {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("No releases yet"))
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/%s/releases/tag/%s", repoName, rel.Tag), http.StatusFound)
+}
+
+func (sc *Smithy) ReleaseView(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
+		return
+	}
+	tag := sc.GetParam(r, "tag")
+
+	if r.Method == http.MethodPost {
+		if !sc.authorizeAdmin(w, r) {
+			return
+		}
+		if err := checkReleaseWrite(repo, ""); err != nil {
+			sc.Error(w, http.StatusForbidden, err)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxAssetSize+1<<20)
+		var err error
+		switch r.FormValue("action") {
+		case "edit":
+			_, err = repo.UpdateRelease(tag, strings.TrimSpace(r.FormValue("title")), r.FormValue("notes"), r.FormValue("prerelease") == "on")
+		case "upload":
+			file, header, ferr := r.FormFile("asset")
+			if ferr != nil {
+				sc.Error(w, http.StatusBadRequest, ferr)
+				return
+			}
+			defer file.Close()
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" {
+				name = header.Filename
+			}
+			_, err = repo.AddReleaseAsset(tag, name, file)
+		case "remove-asset":
+			err = repo.RemoveReleaseAsset(tag, r.FormValue("name"))
+		case "delete":
+			if err := repo.DeleteRelease(tag); err != nil {
+				sc.Error(w, releaseError(err), err)
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf("/%s/releases", repoName), http.StatusSeeOther)
+			return
+		default:
+			err = fmt.Errorf("unknown action %q", r.FormValue("action"))
+		}
+		if err != nil {
+			sc.Error(w, releaseError(err), err)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	rel, err := repo.Release(tag)
+	if err != nil {
+		sc.Error(w, releaseError(err), err)
+		return
+	}
+	commit, tagObject, signature := sc.releaseTag(repo, tag)
+	latest := repo.LatestRelease()
+
+	sc.Render(w, "release", H{
+		"RepoName":    repoName,
+		"Release":     rel,
+		"Notes":       template.HTML(FormatMarkdown(rel.Notes)),
+		"TagCommit":   commit,
+		"TagObject":   tagObject,
+		"Signature":   signature,
+		"IsLatest":    latest != nil && latest.Tag == rel.Tag,
+		"ArchiveName": rel.ArchiveName(repo.Name),
+	})
+}
+
+// releaseTag peels the tag of a release, with the signature of the tag
+// object. A lightweight tag has no tag object.
+func (sc *Smithy) releaseTag(repo RepositoryWithName, tag string) (*object.Commit, *object.Tag, Signature) {
+	ref, err := repo.Repository.Reference(plumbing.NewTagReferenceName(tag), true)
+	if err != nil {
+		return nil, nil, Signature{}
+	}
+	commit, tagObject, _ := PeelToCommit(repo.Repository, ref.Hash())
+	if tagObject == nil {
+		return commit, nil, Signature{}
+	}
+	return commit, tagObject, sc.Keyring.VerifyTag(tagObject)
+}
+
+// ReleaseDownload serves an asset, or SHA256SUMS with the checksums of all
+// assets.
+func (sc *Smithy) ReleaseDownload(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	tag, name := sc.GetParam(r, "tag"), sc.GetParam(r, "asset")
+	if name == "SHA256SUMS" {
+		rel, err := repo.Release(tag)
+		if err != nil {
+			http.Error(w, err.Error(), releaseError(err))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, rel.Checksums())
+		return
+	}
+	f, asset, err := repo.OpenReleaseAsset(tag, name)
+	if err != nil {
+		http.Error(w, err.Error(), releaseError(err))
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", asset.Name))
+	w.Header().Set("ETag", `"`+asset.SHA256+`"`)
+	http.ServeContent(w, r, asset.Name, asset.Uploaded, f)
+}
+
+// ReleaseArchive streams the sources of a release as made by git archive.
+func (sc *Smithy) ReleaseArchive(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	tag, format := sc.GetParam(r, "tag"), sc.GetParam(r, "format")
+	rel, err := repo.Release(tag)
+	if err != nil {
+		http.Error(w, err.Error(), releaseError(err))
+		return
+	}
+	name := rel.ArchiveName(repo.Name)
+	contentType := map[string]string{"tar.gz": "application/gzip", "zip": "application/zip"}[format]
+	cmd := exec.Command("git", "--git-dir", repo.GitDir(), "archive",
+		"--format="+format, "--prefix="+name+"/", plumbing.NewTagReferenceName(tag).String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Hold back the headers until git produced something, so a missing tag
+	// still gets an error status.
+	br := bufio.NewReader(stdout)
+	if _, err := br.Peek(1); err != nil {
+		cmd.Wait()
+		http.Error(w, strings.TrimSpace(stderr.String()), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	io.Copy(w, br)
+	if err := cmd.Wait(); err != nil {
+		log.Printf("archive %s %s: %v: %s", repoName, tag, err, stderr.String())
+	}
+}
+
+// releaseJSON is a release as returned by the API, with the URLs to fetch
+// its downloads and the signatures of its tag and commit. A lightweight tag
+// has no tag signature, an empty signature means unsigned.
+type releaseJSON struct {
+	*Release
+	URL             string             `json:"url"`
+	Latest          bool               `json:"latest"`
+	Assets          []releaseAssetJSON `json:"assets"`
+	Archives        map[string]string  `json:"archives"`
+	SHA256          string             `json:"checksums_url"`
+	Commit          string             `json:"commit,omitempty"`
+	TagSignature    *Signature         `json:"tag_signature,omitempty"`
+	CommitSignature *Signature         `json:"commit_signature,omitempty"`
+}
+
+type releaseAssetJSON struct {
+	ReleaseAsset
+	URL string `json:"url"`
+}
+
+func (sc *Smithy) releaseJSON(repo RepositoryWithName, rel *Release, latest *Release) releaseJSON {
+	base := sc.Config().Site.BaseURL + "/" + repo.Name + "/releases"
+	out := releaseJSON{
+		Release: rel,
+		URL:     base + "/tag/" + rel.Tag,
+		Latest:  latest != nil && latest.Tag == rel.Tag,
+		Assets:  []releaseAssetJSON{},
+		Archives: map[string]string{
+			"tar.gz": base + "/archive/" + rel.Tag + ".tar.gz",
+			"zip":    base + "/archive/" + rel.Tag + ".zip",
+		},
+		SHA256: base + "/download/" + rel.Tag + "/SHA256SUMS",
+	}
+	for _, asset := range rel.Assets {
+		out.Assets = append(out.Assets, releaseAssetJSON{asset, base + "/download/" + rel.Tag + "/" + asset.Name})
+	}
+	commit, tagObject, signature := sc.releaseTag(repo, rel.Tag)
+	if tagObject != nil {
+		out.TagSignature = &signature
+	}
+	if commit != nil {
+		commitSignature := sc.Keyring.VerifyCommit(commit)
+		out.Commit = commit.Hash.String()
+		out.CommitSignature = &commitSignature
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// ReleasesAPI lists the releases, or creates one from a JSON body like
+// {"tag": "v1.0.0", "target": "main", "title": "", "notes": "", "prerelease": false}.
+// Changes need the admin token.
+func (sc *Smithy) ReleasesAPI(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("repository not found"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		releases, err := repo.Releases()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		latest := repo.LatestRelease()
+		out := []releaseJSON{}
+		for _, rel := range releases {
+			out = append(out, sc.releaseJSON(repo, rel, latest))
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		if !sc.authorizeAdmin(w, r) {
+			return
+		}
+		var req struct {
+			Tag        string `json:"tag"`
+			Target     string `json:"target"`
+			Title      string `json:"title"`
+			Notes      string `json:"notes"`
+			Prerelease bool   `json:"prerelease"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		rel, err := sc.createRelease(repo, Release{
+			Tag:        req.Tag,
+			Title:      req.Title,
+			Notes:      req.Notes,
+			Prerelease: req.Prerelease,
+		}, req.Target)
+		if err != nil {
+			writeJSONError(w, releaseError(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, sc.releaseJSON(repo, rel, repo.LatestRelease()))
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("use GET or POST"))
+	}
+}
+
+// ReleaseAPI gets, updates or deletes one release. PATCH takes the fields
+// of ReleasesAPI except tag and target, missing ones keep their value.
+func (sc *Smithy) ReleaseAPI(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("repository not found"))
+		return
+	}
+	tag := sc.GetParam(r, "tag")
+	rel, err := repo.Release(tag)
+	if err != nil {
+		writeJSONError(w, releaseError(err), err)
+		return
+	}
+	if r.Method != http.MethodGet {
+		if !sc.authorizeAdmin(w, r) {
+			return
+		}
+		if err := checkReleaseWrite(repo, ""); err != nil {
+			writeJSONError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		req := struct {
+			Title      *string `json:"title"`
+			Notes      *string `json:"notes"`
+			Prerelease *bool   `json:"prerelease"`
+		}{&rel.Title, &rel.Notes, &rel.Prerelease}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if rel, err = repo.UpdateRelease(tag, rel.Title, rel.Notes, rel.Prerelease); err != nil {
+			writeJSONError(w, releaseError(err), err)
+			return
+		}
+	case http.MethodDelete:
+		if err := repo.DeleteRelease(tag); err != nil {
+			writeJSONError(w, releaseError(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("use GET, PATCH or DELETE"))
+		return
+	}
+	writeJSON(w, http.StatusOK, sc.releaseJSON(repo, rel, repo.LatestRelease()))
+}
+
+// ReleaseAssetAPI uploads an asset with PUT or POST, the request body is
+// the file. DELETE removes it.
+func (sc *Smithy) ReleaseAssetAPI(w http.ResponseWriter, r *http.Request) {
+	repoName := sc.GetParam(r, "repo")
+	repo, exists := sc.FindRepo(repoName)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("repository not found"))
+		return
+	}
+	if !sc.authorizeAdmin(w, r) {
+		return
+	}
+	if err := checkReleaseWrite(repo, ""); err != nil {
+		writeJSONError(w, http.StatusForbidden, err)
+		return
+	}
+	tag, name := sc.GetParam(r, "tag"), sc.GetParam(r, "asset")
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		asset, err := repo.AddReleaseAsset(tag, name, r.Body)
+		if err != nil {
+			writeJSONError(w, releaseError(err), err)
+			return
+		}
+		base := sc.Config().Site.BaseURL + "/" + repo.Name + "/releases"
+		writeJSON(w, http.StatusCreated, releaseAssetJSON{asset, base + "/download/" + tag + "/" + asset.Name})
+	case http.MethodDelete:
+		if err := repo.RemoveReleaseAsset(tag, name); err != nil {
+			writeJSONError(w, releaseError(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("use PUT, POST or DELETE"))
+	}
+}
+
 func (sc *Smithy) WriteGitToHttp(w http.ResponseWriter, gitCommand GitCommand) {
 	cmd := exec.Command("git", gitCommand.args...)
 	stdout, err := cmd.StdoutPipe()
@@ -477,19 +1556,75 @@ func (sc *Smithy) WriteGitToHttp(w http.ResponseWriter, gitCommand GitCommand) {
 	}
 }
 
+// readGitRequest reads the body of a smart HTTP request, git compresses
+// large fetch negotiations.
+func readGitRequest(r *http.Request) ([]byte, error) {
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+	return io.ReadAll(body)
+}
+
+// checkPush tells whether repo takes writes over the git protocols, git
+// pushes as well as LFS uploads and locks.
+func (sc *Smithy) checkPush(repo RepositoryWithName) error {
+	if repo.IsArchived() {
+		return fmt.Errorf("Repository is archived")
+	}
+	if repo.IsMirror() {
+		return fmt.Errorf("Repository is a mirror")
+	}
+	if !sc.Config().For(repo.Name).Features.PushEnabled() {
+		return fmt.Errorf("Pushing is disabled")
+	}
+	return nil
+}
+
 func (sc *Smithy) getInfoRefs(w http.ResponseWriter, r *http.Request) {
 	repoName := sc.GetParam(r, "repo")
 	repo, _ := sc.FindRepo(repoName)
 	log.Printf("getInfoRefs for %s", repo.Path)
 	service := r.URL.Query().Get("service")
+	switch service {
+	case "":
+		// A dumb client, it fetches the files itself.
+		if err := writeInfoRefs(w, repo); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	case "git-upload-pack":
+	case "git-receive-pack":
+		if err := sc.checkPush(repo); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "Unsupported service", http.StatusForbidden)
+		return
+	}
 	serviceName := strings.Replace(service, "git-", "", 1)
 	w.Header().Set("Content-Type", "application/x-git-"+serviceName+"-advertisement")
 	str := "# service=git-" + serviceName
 	fmt.Fprintf(w, "%.4x%s\n", len(str)+offset, str)
 	fmt.Fprintf(w, "0000")
+	if sc.Config().GitBackend == GitBackendGo {
+		if err := goAdvertiseRefs(r.Context(), w, repo, service, sc.Config().For(repo.Name).UploadPack); err != nil {
+			log.Printf("getInfoRefs for %s: %v", repo.Path, err)
+		}
+		return
+	}
 	c := GitCommand{
 		args: []string{serviceName, "--stateless-rpc", "--advertise-refs", repo.Path},
 	}
+	if service == "git-upload-pack" {
+		c.args = append(sc.Config().For(repo.Name).UploadPack.GitOptions(), c.args...)
+	}
 	sc.WriteGitToHttp(w, c)
 }
 
@@ -498,15 +1633,22 @@ func (sc *Smithy) uploadPack(w http.ResponseWriter, r *http.Request) {
 	repo, _ := sc.FindRepo(repoName)
 	log.Printf("uploadPack for %s", repo.Path)
 	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
-	requestBody, err := io.ReadAll(r.Body)
+	requestBody, err := readGitRequest(r)
 	if err != nil {
 		sc.Error(w, http.StatusInternalServerError, err)
 		return
 	}
+	if sc.Config().GitBackend == GitBackendGo {
+		if err := goUploadPack(r.Context(), w, repo, bytes.NewReader(requestBody), sc.Config().For(repo.Name).UploadPack); err != nil {
+			log.Printf("uploadPack for %s: %v", repo.Path, err)
+		}
+		return
+	}
 	c := GitCommand{
 		procInput: bytes.NewReader(requestBody),
 		args:      []string{"upload-pack", "--stateless-rpc", repo.Path},
 	}
+	c.args = append(sc.Config().For(repo.Name).UploadPack.GitOptions(), c.args...)
 	sc.WriteGitToHttp(w, c)
 }
 
@@ -517,16 +1659,35 @@ func (sc *Smithy) receivePack(w http.ResponseWriter, r *http.Request) {
 		sc.Error(w, http.StatusNotFound, fmt.Errorf("Repository not found"))
 		return
 	}
+	if err := sc.checkPush(repo); err != nil {
+		sc.Error(w, http.StatusForbidden, err)
+		return
+	}
 	log.Printf("receivePack for %s", repo.Path)
 	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
-	requestBody, err := io.ReadAll(r.Body)
+	requestBody, err := readGitRequest(r)
 	if err != nil {
 		sc.Error(w, http.StatusInternalServerError, err)
 		return
 	}
-	c := GitCommand{
-		procInput: bytes.NewReader(requestBody),
-		args:      []string{"receive-pack", "--stateless-rpc", repo.Path},
+	before := RefSnapshot(repo.Repository)
+	if sc.Config().GitBackend == GitBackendGo {
+		if err := goReceivePack(r.Context(), w, repo, bytes.NewReader(requestBody)); err != nil {
+			log.Printf("receivePack for %s: %v", repo.Path, err)
+		}
+	} else {
+		c := GitCommand{
+			procInput: bytes.NewReader(requestBody),
+			args:      []string{"receive-pack", "--stateless-rpc", repo.Path},
+		}
+		sc.WriteGitToHttp(w, c)
 	}
-	sc.WriteGitToHttp(w, c)
+	if changed := ChangedRefs(before, RefSnapshot(repo.Repository)); len(changed) > 0 {
+		sc.QueuePush(repo, changed)
+	}
+	go func() {
+		if err := sc.Search.Update(repo); err != nil {
+			log.Printf("search: indexing %s: %v", repo.Name, err)
+		}
+	}()
 }
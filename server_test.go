@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestLogViewMissingCommit(t *testing.T) {
+	sc := newTestSmithy(t)
+	cfg := DefaultConfig()
+	cfg.Root = sc.Root
+	sc.SetConfig(cfg)
+	path := filepath.Join(sc.Root, "repo")
+	repo, err := git.PlainInit(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commitFile(t, repo, "README", "one\n")
+	commitFile(t, repo, "README", "two\n")
+	// The log reaches a parent that is gone.
+	hex := first.String()
+	if err := os.Remove(filepath.Join(path, ".git", "objects", hex[:2], hex[2:])); err != nil {
+		t.Fatal(err)
+	}
+	sc.AddRepository(RepositoryWithName{Name: "repo", Path: path, Repository: repo})
+	if err := sc.LoadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(sc.Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/repo/log/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("log with a missing commit: %s, want 500", resp.Status)
+	}
+}
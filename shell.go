@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// sshServices are the git commands an SSH login may run.
+var sshServices = map[string]bool{
+	"git-upload-pack":    true,
+	"git-receive-pack":   true,
+	"git-upload-archive": true,
+}
+
+// parseSSHCommand splits the command git sends over SSH, like
+// git-upload-pack '/group/repo.git', into the service and the repository
+// name. The path is single quoted the way git quotes it for the shell.
+func parseSSHCommand(command string) (service, name string, err error) {
+	service, arg, ok := strings.Cut(strings.TrimSpace(command), " ")
+	if !ok {
+		return "", "", fmt.Errorf("unsupported command %q", command)
+	}
+	if service == "git" {
+		service, arg, _ = strings.Cut(arg, " ")
+		service = "git-" + service
+	}
+	if !sshServices[service] {
+		return "", "", fmt.Errorf("unsupported command %q", service)
+	}
+	name, err = shellUnquote(strings.TrimSpace(arg))
+	if err != nil {
+		return "", "", err
+	}
+	name = strings.TrimPrefix(name, "~/")
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return "", "", errors.New("no repository given")
+	}
+	return service, name, nil
+}
+
+// shellUnquote undoes the quoting of git's sq_quote: single quoted runs,
+// a quote inside ends the run, is escaped and starts the next one:
+//
+//	'/it'\''s.git' is /it's.git
+func shellUnquote(s string) (string, error) {
+	var b strings.Builder
+	for len(s) > 0 {
+		switch s[0] {
+		case '\'':
+			end := strings.IndexByte(s[1:], '\'')
+			if end < 0 {
+				return "", errors.New("unterminated quote")
+			}
+			b.WriteString(s[1 : end+1])
+			s = s[end+2:]
+		case '\\':
+			if len(s) < 2 {
+				return "", errors.New("trailing backslash")
+			}
+			b.WriteByte(s[1])
+			s = s[2:]
+		case ' ', '\t':
+			return "", errors.New("more than one argument")
+		default:
+			b.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+	return b.String(), nil
+}
+
+// RunShell serves one git command over SSH. It is meant as the forced
+// command of the keys in authorized_keys:
+//
+//	command="smithy -config /etc/smithy.json shell",restrict ssh-ed25519 AAAA...
+//
+// Only repositories below the root are reachable and pushes follow the
+// same rules as over HTTP.
+func (sc *Smithy) RunShell() error {
+	command := os.Getenv("SSH_ORIGINAL_COMMAND")
+	if command == "" {
+		return errors.New("interactive logins are not supported, use git")
+	}
+	service, name, err := parseSSHCommand(command)
+	if err != nil {
+		return err
+	}
+	// Whatever the scan logs would end up in the output of the client.
+	log.SetOutput(io.Discard)
+	sc.LoadAllRepositories()
+	repo, exists := sc.FindRepo(name)
+	if !exists {
+		return fmt.Errorf("repository %s not found", name)
+	}
+	if service == "git-receive-pack" {
+		if err := sc.checkPush(repo); err != nil {
+			return err
+		}
+	}
+
+	before := RefSnapshot(repo.Repository)
+	args := []string{strings.TrimPrefix(service, "git-"), repo.Path}
+	if service == "git-upload-pack" {
+		args = append(sc.Config().For(repo.Name).UploadPack.GitOptions(), args...)
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if service != "git-receive-pack" {
+		return nil
+	}
+	changed := ChangedRefs(before, RefSnapshot(repo.Repository))
+	if len(changed) == 0 {
+		return nil
+	}
+	// This process ends with the session, so the index and the push mirrors
+	// are updated right away instead of in the background, and only once.
+	if err := sc.Search.Update(repo); err != nil {
+		fmt.Fprintf(os.Stderr, "smithy: search: indexing %s: %v\n", repo.Name, err)
+	}
+	if !sc.Config().For(repo.Name).Features.MirrorsEnabled() {
+		return nil
+	}
+	pending := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range changed {
+		pending[ref] = true
+	}
+	for _, mirror := range repo.PushMirrors() {
+		if err := pushToMirror(repo.Repository, mirror, false, pending); err != nil {
+			fmt.Fprintf(os.Stderr, "smithy: push mirror %s: %v\n", mirror.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+)
+
+type SignatureStatus string
+
+const (
+	SignatureNone       SignatureStatus = ""
+	SignatureVerified   SignatureStatus = "verified"
+	SignatureUnverified SignatureStatus = "unverified"
+	SignatureUnknownKey SignatureStatus = "unknown key"
+)
+
+const sshSignatureNamespace = "git"
+
+// Signature is the result of verifying a signed commit or tag.
+type Signature struct {
+	Status SignatureStatus `json:"status,omitempty"`
+	Kind   string          `json:"kind,omitempty"`
+	Signer string          `json:"signer,omitempty"`
+	KeyID  string          `json:"key_id,omitempty"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+func (s Signature) Signed() bool {
+	return s.Status != SignatureNone
+}
+
+// CSSClass is used by the templates to colour the status badge.
+func (s Signature) CSSClass() string {
+	return "signature-" + strings.ReplaceAll(string(s.Status), " ", "-")
+}
+
+// AllowedSigner is one entry of an ssh allowed_signers file.
+type AllowedSigner struct {
+	Principals []string
+	Key        ssh.PublicKey
+}
+
+// Keyring holds the public keys signatures are verified against. Keys are
+// loaded from a directory: OpenPGP keys from *.asc and *.gpg files, SSH keys
+// from files named allowed_signers in the format used by git's
+// gpg.ssh.allowedSignersFile. Files may be grouped in one subdirectory per
+// user.
+type Keyring struct {
+	pgp   openpgp.EntityList
+	ssh   []AllowedSigner
+	cache sync.Map
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+func LoadKeyring(dir string) (*Keyring, error) {
+	k := NewKeyring()
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch {
+		case d.Name() == "allowed_signers":
+			return k.loadAllowedSigners(p)
+		case strings.HasSuffix(d.Name(), ".asc"), strings.HasSuffix(d.Name(), ".gpg"):
+			return k.loadPGPKeys(p)
+		}
+		return nil
+	})
+	return k, err
+}
+
+func (k *Keyring) loadPGPKeys(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	k.pgp = append(k.pgp, entities...)
+	return nil
+}
+
+func (k *Keyring) loadAllowedSigners(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		principals, rest, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("%s:%d: malformed allowed signer", p, n)
+		}
+		// The remainder has the authorized_keys layout, options such as
+		// namespaces="git" included.
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rest))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", p, n, err)
+		}
+		k.ssh = append(k.ssh, AllowedSigner{
+			Principals: strings.Split(principals, ","),
+			Key:        key,
+		})
+	}
+	return scanner.Err()
+}
+
+func (k *Keyring) VerifyCommit(c *object.Commit) Signature {
+	if c.PGPSignature == "" {
+		return Signature{}
+	}
+	if sig, ok := k.cache.Load(c.Hash); ok {
+		return sig.(Signature)
+	}
+	encoded := &plumbing.MemoryObject{}
+	var sig Signature
+	if err := c.EncodeWithoutSignature(encoded); err != nil {
+		sig = Signature{Status: SignatureUnverified, Reason: err.Error()}
+	} else {
+		sig = k.verify(encoded, c.PGPSignature, c.Committer.Email)
+	}
+	k.cache.Store(c.Hash, sig)
+	return sig
+}
+
+func (k *Keyring) VerifyTag(t *object.Tag) Signature {
+	if t.PGPSignature == "" {
+		return Signature{}
+	}
+	if sig, ok := k.cache.Load(t.Hash); ok {
+		return sig.(Signature)
+	}
+	encoded := &plumbing.MemoryObject{}
+	var sig Signature
+	if err := t.EncodeWithoutSignature(encoded); err != nil {
+		sig = Signature{Status: SignatureUnverified, Reason: err.Error()}
+	} else {
+		sig = k.verify(encoded, t.PGPSignature, t.Tagger.Email)
+	}
+	k.cache.Store(t.Hash, sig)
+	return sig
+}
+
+func (k *Keyring) verify(encoded *plumbing.MemoryObject, signature, email string) Signature {
+	r, err := encoded.Reader()
+	if err != nil {
+		return Signature{Status: SignatureUnverified, Reason: err.Error()}
+	}
+	if strings.HasPrefix(signature, "-----BEGIN SSH SIGNATURE-----") {
+		return k.verifySSH(r, signature, email)
+	}
+	return k.verifyPGP(r, signature, email)
+}
+
+func (k *Keyring) verifyPGP(message io.Reader, signature, email string) Signature {
+	sig := Signature{Kind: "gpg"}
+	entity, err := openpgp.CheckArmoredDetachedSignature(k.pgp, message, strings.NewReader(signature), nil)
+	if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+		sig.Status = SignatureUnknownKey
+		return sig
+	}
+	if err != nil {
+		sig.Status = SignatureUnverified
+		sig.Reason = err.Error()
+		return sig
+	}
+	sig.KeyID = entity.PrimaryKey.KeyIdString()
+	for _, identity := range entity.Identities {
+		if strings.EqualFold(identity.UserId.Email, email) {
+			sig.Status = SignatureVerified
+			sig.Signer = identity.Name
+			return sig
+		}
+	}
+	sig.Status = SignatureUnverified
+	sig.Reason = fmt.Sprintf("key %s has no identity for %s", sig.KeyID, email)
+	return sig
+}
+
+// verifySSH checks an SSH signature as produced by ssh-keygen -Y sign, see
+// PROTOCOL.sshsig in the OpenSSH sources.
+func (k *Keyring) verifySSH(message io.Reader, signature, email string) Signature {
+	sig := Signature{Kind: "ssh"}
+	fail := func(err error) Signature {
+		sig.Status = SignatureUnverified
+		sig.Reason = err.Error()
+		return sig
+	}
+
+	block, _ := pem.Decode([]byte(signature))
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return fail(errors.New("malformed ssh signature"))
+	}
+	var blob struct {
+		Magic     [6]byte
+		Version   uint32
+		PublicKey []byte
+		Namespace string
+		Reserved  string
+		HashAlgo  string
+		Signature []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes, &blob); err != nil {
+		return fail(err)
+	}
+	if string(blob.Magic[:]) != "SSHSIG" || blob.Version != 1 {
+		return fail(errors.New("unsupported ssh signature version"))
+	}
+	if blob.Namespace != sshSignatureNamespace {
+		return fail(fmt.Errorf("unexpected signature namespace %q", blob.Namespace))
+	}
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return fail(err)
+	}
+	sig.KeyID = ssh.FingerprintSHA256(pub)
+
+	var principals []string
+	for _, signer := range k.ssh {
+		if bytes.Equal(signer.Key.Marshal(), pub.Marshal()) {
+			principals = signer.Principals
+			break
+		}
+	}
+	if principals == nil {
+		sig.Status = SignatureUnknownKey
+		return sig
+	}
+
+	var h hash.Hash
+	switch blob.HashAlgo {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fail(fmt.Errorf("unsupported hash algorithm %q", blob.HashAlgo))
+	}
+	if _, err := io.Copy(h, message); err != nil {
+		return fail(err)
+	}
+	var s ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &s); err != nil {
+		return fail(err)
+	}
+	signed := ssh.Marshal(struct {
+		Magic     [6]byte
+		Namespace string
+		Reserved  string
+		HashAlgo  string
+		Hash      []byte
+	}{blob.Magic, blob.Namespace, blob.Reserved, blob.HashAlgo, h.Sum(nil)})
+	if err := pub.Verify(signed, &s); err != nil {
+		return fail(err)
+	}
+
+	for _, principal := range principals {
+		if strings.EqualFold(principal, email) {
+			sig.Status = SignatureVerified
+			sig.Signer = principal
+			return sig
+		}
+	}
+	sig.Status = SignatureUnverified
+	sig.Reason = fmt.Sprintf("key %s is not allowed to sign for %s", sig.KeyID, email)
+	return sig
+}
@@ -7,9 +7,12 @@ import (
 	"html/template"
 	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alecthomas/chroma/formatters/html"
@@ -47,61 +50,251 @@ func (r ReferenceByName) Less(i, j int) bool {
 
 type Smithy struct {
 	Root     string
-	repos    map[string]RepositoryWithName
-	template *template.Template
+	Keyring  *Keyring
+	Search   *SearchIndex
+	repos    *Registry
+	config   atomic.Pointer[Config]
+	activity *ActivityCache
+	branches *MainBranchCache
+	imports  *ImportJobs
+	mirrors  *MirrorScheduler
+	pushes   *PushQueue
+	static   atomic.Pointer[StaticAssets]
+	template atomic.Pointer[template.Template]
 }
 
-func NewSmithy(root string) Smithy {
-	return Smithy{
-		Root: root,
+func NewSmithy(root string) *Smithy {
+	sc := &Smithy{
+		Root:     root,
+		Keyring:  NewKeyring(),
+		repos:    NewRegistry(),
+		activity: NewActivityCache(),
+		branches: NewMainBranchCache(),
+		imports:  NewImportJobs(),
+		mirrors:  NewMirrorScheduler(),
+		pushes:   NewPushQueue(),
 	}
+	sc.config.Store(DefaultConfig())
+	sc.static.Store(defaultStaticAssets())
+	return sc
+}
+
+// Config is the current configuration, it is replaced as a whole on reload.
+func (sc *Smithy) Config() *Config {
+	return sc.config.Load()
+}
+
+func (sc *Smithy) SetConfig(cfg *Config) {
+	sc.config.Store(cfg)
 }
 
 func (sc *Smithy) AddRepository(rwn RepositoryWithName) {
-	sc.repos[rwn.Name] = rwn
+	sc.repos.Add(rwn)
 }
 
-func (sc *Smithy) LoadAllRepositories() (err error) {
-	files, err := os.ReadDir(sc.Root)
-	if err != nil {
-		return
+// Repositories is the registry of the served repositories, subscribe to it
+// to follow additions, removals and renames.
+func (sc *Smithy) Repositories() *Registry {
+	return sc.repos
+}
+
+// onRepositoryChange keeps the search index and caches in step with the
+// registry.
+func (sc *Smithy) onRepositoryChange(event RegistryEvent) {
+	switch event.Kind {
+	case RepoAdded:
+		go sc.Search.Update(event.Repo)
+	case RepoRemoved:
+		sc.Search.Remove(event.Repo.Name)
+		sc.forget(event.Repo.Name)
+	case RepoRenamed:
+		sc.Search.Remove(event.OldName)
+		sc.forget(event.OldName)
+		go sc.Search.Update(event.Repo)
 	}
-	sc.repos = make(map[string]RepositoryWithName)
-	for _, f := range files {
-		repoPath := path.Join(sc.Root, f.Name())
-		r, err := git.PlainOpen(repoPath)
-		if err != nil {
+}
+
+func (sc *Smithy) forget(name string) {
+	sc.activity.Forget(name)
+	sc.branches.Forget(name)
+}
+
+// reservedNames can't be used for top level repositories as they collide
+// with other routes.
+var reservedNames = map[string]bool{
+	"feed.atom": true,
+	"new":       true,
+	"import":    true,
+	"reload":    true,
+	"search":    true,
+	"static":    true,
+}
+
+var repoNameSegment = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// ValidateRepoName checks that name is a relative path below Root made of
+// plain segments, e.g. "team/service.git".
+func ValidateRepoName(name string) error {
+	if name == "" {
+		return errors.New("repository name is empty")
+	}
+	segments := strings.Split(name, "/")
+	if reservedNames[segments[0]] {
+		return fmt.Errorf("%q is a reserved name", segments[0])
+	}
+	for _, segment := range segments {
+		if len(segment) > 100 || !repoNameSegment.MatchString(segment) {
+			return fmt.Errorf("invalid repository name %q: use letters, digits, '.', '_' and '-' separated by '/'", name)
+		}
+	}
+	return nil
+}
+
+// checkNesting refuses names inside an existing repository, which would
+// put the new one into the git directory of the other.
+func (sc *Smithy) checkNesting(name string) error {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '/' {
 			continue
 		}
-		key := f.Name()
-		rwn := RepositoryWithName{
-			Name:       f.Name(),
-			Repository: r,
-			Path:       repoPath,
+		if parent, exists := sc.FindRepo(name[:i]); exists {
+			return fmt.Errorf("%s is inside repository %s", name, parent.Name)
 		}
-		sc.repos[key] = rwn
+		if _, err := git.PlainOpen(filepath.Join(sc.Root, filepath.FromSlash(name[:i]))); err == nil {
+			return fmt.Errorf("%s is inside repository %s", name, name[:i])
+		}
+	}
+	return nil
+}
+
+func (sc *Smithy) RenameRepository(oldName, newName string) (RepositoryWithName, error) {
+	repo, exists := sc.FindRepo(oldName)
+	if !exists {
+		return repo, errors.New("repository not found")
+	}
+	if err := ValidateRepoName(newName); err != nil {
+		return repo, err
+	}
+	if err := sc.checkNesting(newName); err != nil {
+		return repo, err
 	}
+	if _, exists := sc.FindRepo(newName); exists {
+		return repo, fmt.Errorf("repository %s already exists", newName)
+	}
+	newPath := filepath.Join(sc.Root, filepath.FromSlash(newName))
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return repo, err
+	}
+	if err := os.Rename(repo.Path, newPath); err != nil {
+		return repo, err
+	}
+	r, err := git.PlainOpen(newPath)
+	if err != nil {
+		return repo, err
+	}
+	renamed := RepositoryWithName{Name: newName, Path: newPath, Repository: r}
+	if err := sc.repos.Rename(repo.Name, renamed); err != nil {
+		return repo, err
+	}
+	if err := sc.relinkForks(repo.Name, renamed); err != nil {
+		return renamed, err
+	}
+	return renamed, nil
+}
+
+func (sc *Smithy) DeleteRepository(name string) error {
+	repo, exists := sc.FindRepo(name)
+	if !exists {
+		return errors.New("repository not found")
+	}
+	if err := sc.detachForks(repo); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(repo.Path); err != nil {
+		return err
+	}
+	sc.repos.Remove(repo.Name)
+	return nil
+}
+
+// LoadAllRepositories discovers repositories below Root. Directories that
+// are not repositories are groups and are searched recursively; hidden
+// directories are skipped.
+func (sc *Smithy) LoadAllRepositories() (err error) {
+	_, err = sc.Rescan()
 	return
 }
 
 func (sc *Smithy) GetRepositories() []RepositoryWithName {
-	var repos []RepositoryWithName
-	for _, repo := range sc.repos {
-		repos = append(repos, repo)
-	}
-	sort.Sort(RepositoryByName(repos))
-	return repos
+	return sc.repos.List()
+}
+
+func (sc *Smithy) MainBranch(rwn RepositoryWithName) (string, *plumbing.Hash, error) {
+	return sc.branches.MainBranch(rwn)
 }
 
+// FindRepo looks up a repository by name. Like git, "name" and "name.git"
+// refer to the same repository.
 func (sc *Smithy) FindRepo(slug string) (RepositoryWithName, bool) {
-	value, exists := sc.repos[slug]
-	return value, exists
+	return sc.repos.Find(slug)
+}
+
+// MatchRepo finds the longest leading part of an URL path naming a
+// repository. It is the PrefixFunc for repository routes.
+func (sc *Smithy) MatchRepo(urlPath string) (string, string, bool) {
+	for i := len(urlPath); i > 1; i-- {
+		if i < len(urlPath) && urlPath[i] != '/' {
+			continue
+		}
+		if repo, exists := sc.FindRepo(urlPath[1:i]); exists {
+			return repo.Name, urlPath[i:], true
+		}
+	}
+	return "", "", false
+}
+
+// GetGroup lists the subgroups and repositories directly inside group, the
+// empty group being the root.
+func (sc *Smithy) GetGroup(group string) (groups []string, repos []RepositoryWithName, exists bool) {
+	prefix := ""
+	if group != "" {
+		prefix = group + "/"
+	}
+	seen := make(map[string]bool)
+	for _, repo := range sc.GetRepositories() {
+		if !strings.HasPrefix(repo.Name, prefix) || repo.IsUnlisted() {
+			continue
+		}
+		exists = true
+		rest := strings.TrimPrefix(repo.Name, prefix)
+		if sub, _, nested := strings.Cut(rest, "/"); nested {
+			if !seen[sub] {
+				seen[sub] = true
+				groups = append(groups, prefix+sub)
+			}
+			continue
+		}
+		repos = append(repos, repo)
+	}
+	return groups, repos, exists || group == ""
 }
 
 type Commit struct {
 	Commit    *object.Commit
 	Subject   string
 	ShortHash string
+	Refs      []*plumbing.Reference
+	Signature Signature
+}
+
+func (sc *Smithy) NewCommit(commit *object.Commit, decorations map[plumbing.Hash][]*plumbing.Reference) Commit {
+	return Commit{
+		Commit:    commit,
+		Subject:   strings.Split(commit.Message, "\n")[0],
+		ShortHash: commit.Hash.String()[:8],
+		Refs:      decorations[commit.Hash],
+		Signature: sc.Keyring.VerifyCommit(commit),
+	}
 }
 
 func (c *Commit) CommitDate() string {
@@ -183,11 +376,21 @@ func FormatMarkdown(input string) string {
 	return buf.String()
 }
 
+var ErrEmptyRepository = errors.New("repository has no branches")
+
+// FindMainBranch returns the branch HEAD points at. Only when HEAD is
+// detached or names a branch that doesn't exist it guesses, preferring main
+// and master.
 func FindMainBranch(repo *git.Repository) (string, *plumbing.Hash, error) {
+	if head, err := repo.Head(); err == nil && head.Name().IsBranch() {
+		hash := head.Hash()
+		return head.Name().Short(), &hash, nil
+	}
+
 	branches, _ := ListBranches(repo)
 
 	if len(branches) == 0 {
-		return "", nil, errors.New("no branches found")
+		return "", nil, ErrEmptyRepository
 	}
 
 	var branch string
@@ -204,6 +407,59 @@ func FindMainBranch(repo *git.Repository) (string, *plumbing.Hash, error) {
 	return branch, revision, err
 }
 
+type mainBranchEntry struct {
+	head   string
+	branch string
+}
+
+// MainBranchCache remembers the main branch of each repository for as long
+// as HEAD is unchanged and the branch still exists. HEAD counts as changed
+// when the branch it names comes or goes, so a fallback makes way for it.
+type MainBranchCache struct {
+	mu      sync.Mutex
+	entries map[string]mainBranchEntry
+}
+
+func NewMainBranchCache() *MainBranchCache {
+	return &MainBranchCache{entries: make(map[string]mainBranchEntry)}
+}
+
+func (mc *MainBranchCache) Forget(name string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.entries, name)
+}
+
+func (mc *MainBranchCache) MainBranch(rwn RepositoryWithName) (string, *plumbing.Hash, error) {
+	var head string
+	if ref, err := rwn.Repository.Storer.Reference(plumbing.HEAD); err == nil {
+		head = ref.String()
+		if _, err := rwn.Repository.Reference(plumbing.HEAD, true); err == nil {
+			head += " resolved"
+		}
+	}
+
+	mc.mu.Lock()
+	entry, ok := mc.entries[rwn.Name]
+	mc.mu.Unlock()
+	if ok && entry.head == head {
+		ref, err := rwn.Repository.Reference(plumbing.NewBranchReferenceName(entry.branch), true)
+		if err == nil {
+			hash := ref.Hash()
+			return entry.branch, &hash, nil
+		}
+	}
+
+	branch, hash, err := FindMainBranch(rwn.Repository)
+	if err != nil {
+		return branch, hash, err
+	}
+	mc.mu.Lock()
+	mc.entries[rwn.Name] = mainBranchEntry{head: head, branch: branch}
+	mc.mu.Unlock()
+	return branch, hash, nil
+}
+
 func GetChanges(commit *object.Commit) (object.Changes, error) {
 	var changes object.Changes
 	var parentTree *object.Tree
@@ -249,3 +505,115 @@ func FormatChanges(changes object.Changes) (string, error) {
 
 	return strings.Join(s, "\n\n\n\n"), nil
 }
+
+var ErrAmbiguousHash = errors.New("ambiguous commit hash")
+
+// ResolveCommit finds a commit by its full or abbreviated hash.
+func ResolveCommit(repo *git.Repository, id string) (*object.Commit, error) {
+	id = strings.ToLower(id)
+	if len(id) < 4 || len(id) > 40 || !isHex(id) {
+		return nil, fmt.Errorf("invalid commit hash %q", id)
+	}
+	if len(id) == 40 {
+		return repo.CommitObject(plumbing.NewHash(id))
+	}
+	iter, err := repo.CommitObjects()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	var found *object.Commit
+	for {
+		commit, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(commit.Hash.String(), id) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%w: %s", ErrAmbiguousHash, id)
+		}
+		found = commit
+	}
+	if found == nil {
+		return nil, plumbing.ErrObjectNotFound
+	}
+	return found, nil
+}
+
+// ResolveRevision resolves a revision expression such as a branch or tag
+// name, an abbreviated hash, HEAD~3 or v1.0^{commit} to a commit hash.
+// Unlike git.Repository.ResolveRevision, an abbreviated hash matching more
+// than one commit is reported as ambiguous.
+func ResolveRevision(repo *git.Repository, rev string) (*plumbing.Hash, error) {
+	base := revisionBase(rev)
+	suffix := rev[len(base):]
+	for _, peel := range []string{"^{commit}", "^{}"} {
+		suffix = strings.ReplaceAll(suffix, peel, "")
+	}
+	if strings.Contains(suffix, "^{") {
+		return nil, fmt.Errorf("unsupported revision %q", rev)
+	}
+	if isHex(base) {
+		if _, err := ExpandRef(repo, base); err != nil {
+			commit, err := ResolveCommit(repo, base)
+			if err != nil {
+				return nil, err
+			}
+			base = commit.Hash.String()
+		}
+	}
+	return repo.ResolveRevision(plumbing.Revision(base + suffix))
+}
+
+// revisionBase strips the suffixes like ~3 or ^{commit} from rev.
+func revisionBase(rev string) string {
+	if i := strings.IndexAny(rev, "~^@:"); i >= 0 {
+		return rev[:i]
+	}
+	return rev
+}
+
+// ExpandRef finds the reference a short name refers to, using the same rules
+// as git rev-parse.
+func ExpandRef(repo *git.Repository, name string) (*plumbing.Reference, error) {
+	for _, rule := range plumbing.RefRevParseRules {
+		ref, err := repo.Reference(plumbing.ReferenceName(fmt.Sprintf(rule, name)), true)
+		if err == nil {
+			return ref, nil
+		}
+	}
+	return nil, plumbing.ErrReferenceNotFound
+}
+
+func isHex(s string) bool {
+	return s != "" && strings.Trim(strings.ToLower(s), "0123456789abcdef") == ""
+}
+
+// SplitRefPath splits the tail of a tree URL into a revision and a path.
+// Branch names may contain slashes, so the shortest prefix that resolves
+// wins; git does not allow both "a" and "a/b" to exist as refs. Refs are
+// tried before hashes, cafe in the branch cafe/x may abbreviate a commit.
+func SplitRefPath(repo *git.Repository, rest string) (string, string, error) {
+	rest = strings.Trim(rest, "/")
+	for _, refsOnly := range []bool{true, false} {
+		for i := 0; i <= len(rest); i++ {
+			if i < len(rest) && rest[i] != '/' {
+				continue
+			}
+			if refsOnly {
+				if _, err := ExpandRef(repo, revisionBase(rest[:i])); err != nil {
+					continue
+				}
+			}
+			if _, err := ResolveRevision(repo, rest[:i]); err == nil {
+				return rest[:i], strings.TrimPrefix(rest[i:], "/"), nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("no revision found in %q", rest)
+}
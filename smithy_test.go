@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestSplitRefPathPrefersRefs(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commitFile(t, repo, "README", "one\n")
+	second := commitFile(t, repo, "README", "two\n")
+	// The branch starts like the hash of another commit.
+	branch := first.String()[:4] + "/x"
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), second)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ rest, rev, path string }{
+		{branch + "/README", branch, "README"},
+		{branch + "~1/README", branch + "~1", "README"},
+		{first.String()[:4] + "/README", first.String()[:4], "README"},
+		{second.String()[:7], second.String()[:7], ""},
+	} {
+		rev, path, err := SplitRefPath(repo, tc.rest)
+		if err != nil || rev != tc.rev || path != tc.path {
+			t.Errorf("%s: %q %q %v, want %q %q", tc.rest, rev, path, err, tc.rev, tc.path)
+		}
+	}
+}
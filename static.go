@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+)
+
+//go:embed static
+var staticfiles embed.FS
+
+// The chroma styles of the highlighted code in READMEs, light and dark.
+const (
+	chromaLightStyle = "github"
+	chromaDarkStyle  = "monokai"
+)
+
+type staticAsset struct {
+	content []byte
+	hash    string
+}
+
+// StaticAssets are the stylesheets, scripts and icons served below
+// /static/. Their URLs carry a hash of the content, so browsers may cache
+// them forever and still see a new version right away.
+type StaticAssets struct {
+	files   map[string]staticAsset
+	modTime time.Time
+}
+
+// LoadStaticAssets reads every file of fsys and adds the generated
+// chroma.css.
+func LoadStaticAssets(fsys fs.FS) (*StaticAssets, error) {
+	sa := &StaticAssets{files: make(map[string]staticAsset), modTime: time.Now()}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sa.add(name, content)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	css, err := chromaCSS()
+	if err != nil {
+		return nil, err
+	}
+	sa.add("chroma.css", css)
+	return sa, nil
+}
+
+func (sa *StaticAssets) add(name string, content []byte) {
+	sum := sha256.Sum256(content)
+	sa.files[name] = staticAsset{content: content, hash: hex.EncodeToString(sum[:])[:12]}
+}
+
+// chromaCSS styles highlighted code, switching to the dark style with the
+// color scheme of the browser.
+func chromaCSS() ([]byte, error) {
+	var buf bytes.Buffer
+	formatter := html.New(html.WithClasses(true))
+	if err := formatter.WriteCSS(&buf, styles.Get(chromaLightStyle)); err != nil {
+		return nil, err
+	}
+	buf.WriteString("@media (prefers-color-scheme: dark) {\n")
+	if err := formatter.WriteCSS(&buf, styles.Get(chromaDarkStyle)); err != nil {
+		return nil, err
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// URL is the versioned URL of the named asset.
+func (sa *StaticAssets) URL(name string) string {
+	asset, ok := sa.files[name]
+	if !ok {
+		return "/static/" + name
+	}
+	return "/static/" + name + "?v=" + asset.hash
+}
+
+func defaultStaticAssets() *StaticAssets {
+	sa, err := LoadStaticAssets(themeFS(staticfiles, "static", ""))
+	if err != nil {
+		panic(err)
+	}
+	return sa
+}
+
+// LoadStatic reads the embedded assets, files of the static directory
+// replace the embedded ones of the same name.
+func (sc *Smithy) LoadStatic() error {
+	sa, err := LoadStaticAssets(themeFS(staticfiles, "static", sc.Config().Static))
+	if err != nil {
+		return err
+	}
+	sc.static.Store(sa)
+	return nil
+}
+
+func (sc *Smithy) Static() *StaticAssets {
+	return sc.static.Load()
+}
+
+func (sc *Smithy) StaticView(w http.ResponseWriter, r *http.Request) {
+	if sc.Config().Dev {
+		if err := sc.LoadStatic(); err != nil {
+			log.Printf("theme: %v", err)
+		}
+	}
+	static := sc.Static()
+	name := sc.GetParam(r, "path")
+	asset, ok := static.files[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// Only the current version may be cached for good, an old hash gets
+	// the new content and has to be checked again.
+	if r.URL.Query().Get("v") == asset.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", `"`+asset.hash+`"`)
+	http.ServeContent(w, r, name, static.modTime, bytes.NewReader(asset.content))
+}
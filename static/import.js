@@ -0,0 +1,18 @@
+// Streams the progress of a running import into #progress and reloads the
+// page once the job is done.
+(async () => {
+  const progress = document.getElementById("progress");
+  if (!progress || !progress.dataset.stream) return;
+  const res = await fetch(progress.dataset.stream);
+  const reader = res.body.getReader();
+  const decoder = new TextDecoder();
+  let text = "";
+  for (;;) {
+    const { done, value } = await reader.read();
+    if (done) break;
+    text += decoder.decode(value, { stream: true });
+    // Progress lines are redrawn with carriage returns.
+    progress.textContent = text.split("\n").map(l => l.split("\r").filter(Boolean).pop() || "").join("\n");
+  }
+  location.reload();
+})();
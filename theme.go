@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// overlayFS serves the files of upper, falling back to lower for the ones
+// upper doesn't have. Directory listings are merged.
+type overlayFS struct {
+	upper, lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	return o.lower.Open(name)
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, upperErr := fs.ReadDir(o.upper, name)
+	lower, lowerErr := fs.ReadDir(o.lower, name)
+	if upperErr != nil && lowerErr != nil {
+		return nil, upperErr
+	}
+	merged := make(map[string]fs.DirEntry)
+	for _, entry := range lower {
+		merged[entry.Name()] = entry
+	}
+	for _, entry := range upper {
+		merged[entry.Name()] = entry
+	}
+	entries := make([]fs.DirEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// themeFS is the embedded dir, with the files of override, when set,
+// replacing the embedded ones of the same name.
+func themeFS(embedded fs.FS, dir, override string) fs.FS {
+	fsys, err := fs.Sub(embedded, dir)
+	if err != nil {
+		panic(err)
+	}
+	if override == "" {
+		return fsys
+	}
+	return overlayFS{upper: os.DirFS(override), lower: fsys}
+}
+
+// LoadTheme loads the templates and static assets. Either is only replaced
+// when it loaded without errors, so a broken edit keeps the last good theme.
+func (sc *Smithy) LoadTheme() error {
+	return errors.Join(sc.LoadStatic(), sc.LoadTemplates())
+}
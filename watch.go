@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// watchDebounce gives git init or a copy time to finish before the root is
+// scanned, filesystem events come in bursts.
+const watchDebounce = 500 * time.Millisecond
+
+// dirWatcher reports changes to the entries of the directories it watches.
+// Events carry no details, any change triggers a rescan.
+type dirWatcher interface {
+	Add(dir string) error
+	Events() <-chan struct{}
+	Close() error
+}
+
+type RescanResult struct {
+	Added   []string
+	Removed []string
+	// Dirs are the directories below Root holding repositories or groups.
+	Dirs []string
+}
+
+// scanRoot finds every repository below Root. Repositories can't nest,
+// hidden directories are skipped.
+func (sc *Smithy) scanRoot() (found map[string]string, dirs []string, err error) {
+	found = make(map[string]string)
+	dirs = []string{sc.Root}
+	err = filepath.WalkDir(sc.Root, func(repoPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || repoPath == sc.Root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if _, err := git.PlainOpen(repoPath); err != nil {
+			dirs = append(dirs, repoPath)
+			return nil
+		}
+		name, err := filepath.Rel(sc.Root, repoPath)
+		if err != nil {
+			return err
+		}
+		found[filepath.ToSlash(name)] = repoPath
+		return filepath.SkipDir
+	})
+	return found, dirs, err
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// Rescan brings the repositories in line with what is on disk, opening the
+// new ones and dropping the ones that are gone. Repositories that didn't
+// change keep their entry.
+func (sc *Smithy) Rescan() (RescanResult, error) {
+	var result RescanResult
+	found, dirs, err := sc.scanRoot()
+	if err != nil {
+		return result, err
+	}
+	result.Dirs = dirs
+
+	var added []RepositoryWithName
+	for name, repoPath := range found {
+		if _, exists := sc.FindRepo(name); exists {
+			continue
+		}
+		r, err := git.PlainOpen(repoPath)
+		if err != nil {
+			continue
+		}
+		added = append(added, RepositoryWithName{Name: name, Path: repoPath, Repository: r})
+	}
+
+	for _, rwn := range added {
+		// It may have been deleted since the scan.
+		if isDir(rwn.Path) && sc.repos.AddIfAbsent(rwn) {
+			result.Added = append(result.Added, rwn.Name)
+		}
+	}
+	for _, rwn := range sc.repos.List() {
+		if _, ok := found[rwn.Name]; ok {
+			continue
+		}
+		// Keep repositories created or imported since the scan.
+		gone := sc.repos.RemoveIf(rwn.Name, func(current RepositoryWithName) bool {
+			return current.Path == rwn.Path && !isDir(current.Path)
+		})
+		if gone {
+			result.Removed = append(result.Removed, rwn.Name)
+		}
+	}
+
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	return result, nil
+}
+
+// rescan runs Rescan and watches the directories it found.
+func (sc *Smithy) rescan(w dirWatcher) {
+	result, err := sc.Rescan()
+	if err != nil {
+		log.Printf("watch: scanning %s: %v", sc.Root, err)
+		return
+	}
+	for _, name := range result.Removed {
+		log.Printf("watch: removed %s", name)
+	}
+	for _, name := range result.Added {
+		log.Printf("watch: added %s", name)
+	}
+	// Pushes over SSH or straight to the directories aren't seen by the
+	// server, they are indexed here.
+	go sc.Search.UpdateStale(sc.GetRepositories())
+	if w == nil {
+		return
+	}
+	for _, dir := range result.Dirs {
+		if err := w.Add(dir); err != nil {
+			log.Printf("watch: %s: %v", dir, err)
+		}
+	}
+}
+
+// Watch keeps the repositories in sync with Root. It reacts to filesystem
+// events where the platform supports them and rescans every interval
+// regardless, in case events were missed.
+func (sc *Smithy) Watch(interval time.Duration) {
+	w, err := newDirWatcher()
+	if err != nil {
+		log.Printf("watch: %v, rescanning every %s", err, interval)
+		w = nil
+	}
+	var events <-chan struct{}
+	if w != nil {
+		defer w.Close()
+		events = w.Events()
+		sc.rescan(w)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var debounce <-chan time.Time
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				log.Printf("watch: events stopped, rescanning every %s", interval)
+				events = nil
+				continue
+			}
+			if debounce == nil {
+				debounce = time.After(watchDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			sc.rescan(w)
+		case <-ticker.C:
+			sc.rescan(w)
+		}
+	}
+}